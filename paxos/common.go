@@ -0,0 +1,74 @@
+package paxos
+
+import (
+	"umich.edu/eecs491/proj2/transport"
+)
+
+//
+// Every message carries the sender's index and the highest seq
+// it has passed to Done(), so that peers learn about each other's
+// progress (and can forget old instances) without extra RPCs.
+//
+
+type PrepareArgs struct {
+	Seq  int
+	N    int // proposal #
+	Me   int
+	Done int
+}
+
+type PrepareReply struct {
+	OK   bool
+	Np   int         // highest proposal # the acceptor has seen
+	Na   int         // proposal # of its highest accept, -1 if none
+	Va   interface{} // value of its highest accept
+	Me   int
+	Done int
+}
+
+type AcceptArgs struct {
+	Seq  int
+	N    int
+	V    interface{}
+	Me   int
+	Done int
+}
+
+type AcceptReply struct {
+	OK   bool
+	Np   int
+	Me   int
+	Done int
+}
+
+type DecidedArgs struct {
+	Seq  int
+	V    interface{}
+	Me   int
+	Done int
+}
+
+type DecidedReply struct {
+}
+
+//
+// call() sends an RPC to the rpcname handler on server srv
+// with arguments args, waits for the reply, and leaves the
+// reply in reply. the reply argument should be a pointer
+// to a reply structure.
+//
+// the return value is true if the server responded, and false
+// if call() was not able to contact the server. in particular,
+// the reply's contents are only valid if call() returned true.
+//
+func call(srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	c, errx := transport.Dial(srv)
+	if errx != nil {
+		return false
+	}
+	defer c.Close()
+
+	err := c.Call(rpcname, args, reply)
+	return err == nil
+}
@@ -0,0 +1,456 @@
+package paxos
+
+//
+// Paxos library, to be included in an application.
+// Multiple applications will run, each including
+// a Paxos peer.
+//
+// Manages a sequence of agreed-on values.
+// The set of peers is fixed.
+// Copes with network failures (partition, msg loss, &c).
+// Does not store anything persistently, so a peer that restarts
+// has forgotten what it promised. The application has to bring it
+// back up to date itself, and keep it from voting again if it had
+// voted before (see SitOut and Voted).
+//
+// The application interface:
+//
+// px = paxos.Make(peers []string, me int, rpcs *rpc.Server, term)
+// px.Start(seq int, v interface{}) -- start agreement on new instance
+// px.Status(seq int) (Fate, v interface{}) -- get info about an instance
+// px.Done(seq int) -- ok to forget all instances <= seq
+// px.Max() int -- highest instance seq known, or -1
+// px.Min() int -- instances before this seq have been forgotten
+// px.SitOut(seq int) -- take no part as an acceptor in instances <= seq
+// px.Voted(peer int) bool -- do we know peer has voted in some instance?
+//
+// Values passed to Start() travel in RPCs, so their concrete
+// types must be registered with encoding/gob by the application.
+//
+
+import (
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// px.Status() return values, indicating
+// whether an agreement has been decided,
+// or Paxos has not yet reached agreement,
+// or it was agreed but forgotten (i.e. < Min()).
+type Fate int
+
+const (
+	Decided   Fate = iota + 1
+	Pending        // not yet decided.
+	Forgotten      // decided but forgotten.
+)
+
+// per-instance acceptor and learner state
+type instance struct {
+	np      int         // highest prepare seen
+	na      int         // highest accept seen
+	va      interface{} // value of highest accept seen
+	decided bool
+	v       interface{} // decided value
+}
+
+type Paxos struct {
+	mu    sync.Mutex
+	dead  <-chan interface{}
+	peers []string
+	me    int // index into peers[]
+
+	instances map[int]*instance
+	done      []int  // highest seq each peer has called Done() with
+	max       int    // highest seq seen
+	horizon   int    // we do not accept or promise anything in instances up to this one
+	voted     []bool // peers we know have promised or accepted something
+}
+
+//
+// has this peer been asked to shut down?
+//
+func (px *Paxos) isdead() bool {
+	select {
+	case <-px.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// get (or create) the state for an instance. caller holds px.mu.
+func (px *Paxos) instance(seq int) *instance {
+	ins, ok := px.instances[seq]
+	if !ok {
+		ins = &instance{np: -1, na: -1}
+		px.instances[seq] = ins
+		if seq > px.max {
+			px.max = seq
+		}
+	}
+	return ins
+}
+
+//
+// the application wants paxos to start agreement on
+// instance seq, with proposed value v.
+// Start() returns right away; the application will
+// call Status() to find out if/when agreement
+// is reached.
+//
+func (px *Paxos) Start(seq int, v interface{}) {
+	if seq < px.Min() {
+		return
+	}
+	go px.propose(seq, v)
+}
+
+//
+// run the proposer for one instance until it is decided
+// (by us or anyone else) or we are killed.
+//
+func (px *Paxos) propose(seq int, v interface{}) {
+	round := 0
+	for !px.isdead() {
+		px.mu.Lock()
+		ins := px.instance(seq)
+		if ins.decided {
+			px.mu.Unlock()
+			return
+		}
+		// proposal numbers are unique per peer, and above anything seen so far
+		for round*len(px.peers)+px.me <= ins.np {
+			round++
+		}
+		n := round*len(px.peers) + px.me
+		px.mu.Unlock()
+
+		// phase 1
+		prepared := 0
+		na := -1
+		va := v
+		for i := range px.peers {
+			args := &PrepareArgs{Seq: seq, N: n, Me: px.me, Done: px.doneValue()}
+			var reply PrepareReply
+			if px.call(i, "Paxos.Prepare", args, &reply) {
+				px.learnDone(reply.Me, reply.Done)
+				px.sawProposal(seq, reply.Np)
+				if reply.OK {
+					px.learnVoted(i)
+					prepared++
+					if reply.Na > na {
+						na = reply.Na
+						va = reply.Va
+					}
+				}
+			}
+		}
+
+		// phase 2
+		if prepared > len(px.peers)/2 {
+			accepted := 0
+			for i := range px.peers {
+				args := &AcceptArgs{Seq: seq, N: n, V: va, Me: px.me, Done: px.doneValue()}
+				var reply AcceptReply
+				if px.call(i, "Paxos.Accept", args, &reply) {
+					px.learnDone(reply.Me, reply.Done)
+					px.sawProposal(seq, reply.Np)
+					if reply.OK {
+						px.learnVoted(i)
+						accepted++
+					}
+				}
+			}
+
+			// phase 3
+			if accepted > len(px.peers)/2 {
+				for i := range px.peers {
+					args := &DecidedArgs{Seq: seq, V: va, Me: px.me, Done: px.doneValue()}
+					var reply DecidedReply
+					px.call(i, "Paxos.Decided", args, &reply)
+				}
+				return
+			}
+		}
+
+		// lost to someone else; back off before trying again
+		round++
+		time.Sleep(time.Duration(rand.Intn(20)+10) * time.Millisecond)
+	}
+}
+
+// remember the highest proposal # anyone told us about
+func (px *Paxos) sawProposal(seq int, np int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if seq < px.minLocked() {
+		return
+	}
+	ins := px.instance(seq)
+	if np > ins.np {
+		ins.np = np
+	}
+}
+
+//
+// Prepare handler (acceptor).
+//
+func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+	px.learnDone(args.Me, args.Done)
+	px.learnVoted(args.Me)
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	reply.Me = px.me
+	reply.Done = px.done[px.me]
+	if args.Seq < px.minLocked() || args.Seq <= px.horizon {
+		reply.OK = false
+		return nil
+	}
+
+	ins := px.instance(args.Seq)
+	if args.N > ins.np {
+		ins.np = args.N
+		reply.OK = true
+		reply.Na = ins.na
+		reply.Va = ins.va
+	}
+	reply.Np = ins.np
+	return nil
+}
+
+//
+// Accept handler (acceptor).
+//
+func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
+	px.learnDone(args.Me, args.Done)
+	px.learnVoted(args.Me)
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	reply.Me = px.me
+	reply.Done = px.done[px.me]
+	if args.Seq < px.minLocked() || args.Seq <= px.horizon {
+		reply.OK = false
+		return nil
+	}
+
+	ins := px.instance(args.Seq)
+	if args.N >= ins.np {
+		ins.np = args.N
+		ins.na = args.N
+		ins.va = args.V
+		reply.OK = true
+	}
+	reply.Np = ins.np
+	return nil
+}
+
+//
+// Decided handler (learner).
+//
+func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
+	px.learnDone(args.Me, args.Done)
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if args.Seq < px.minLocked() {
+		return nil
+	}
+	ins := px.instance(args.Seq)
+	ins.decided = true
+	ins.v = args.V
+	return nil
+}
+
+//
+// the application on this machine is done with
+// all instances <= seq.
+//
+// see the comments for Min() for more explanation.
+//
+func (px *Paxos) Done(seq int) {
+	px.mu.Lock()
+	if seq > px.done[px.me] {
+		px.done[px.me] = seq
+	}
+	px.mu.Unlock()
+	px.forget()
+}
+
+//
+// take no part as an acceptor in instances up through seq. for a
+// peer that restarted and no longer knows what it promised or
+// accepted, lest it go back on a promise and let a second value be
+// decided; the other peers decide those without us. we still
+// propose, and learn their decisions.
+//
+func (px *Paxos) SitOut(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.horizon = seq
+}
+
+// a peer that proposes has voted for itself, or is about to
+func (px *Paxos) learnVoted(peer int) {
+	px.mu.Lock()
+	if peer >= 0 && peer < len(px.voted) && peer != px.me {
+		px.voted[peer] = true
+	}
+	px.mu.Unlock()
+}
+
+//
+// do we know that peer has promised or accepted something? if a
+// restarted peer finds that someone does, it voted before and may
+// not vote again.
+//
+func (px *Paxos) Voted(peer int) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return peer >= 0 && peer < len(px.voted) && px.voted[peer]
+}
+
+// the highest seq peer has told us it is done with, -1 if none
+func (px *Paxos) PeerDone(peer int) int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if peer < 0 || peer >= len(px.done) {
+		return -1
+	}
+	return px.done[peer]
+}
+
+func (px *Paxos) doneValue() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.done[px.me]
+}
+
+// a peer told us how far it is done
+func (px *Paxos) learnDone(peer int, done int) {
+	px.mu.Lock()
+	if peer >= 0 && peer < len(px.done) && done > px.done[peer] {
+		px.done[peer] = done
+	}
+	px.mu.Unlock()
+	px.forget()
+}
+
+// free the instances everyone is done with
+func (px *Paxos) forget() {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	min := px.minLocked()
+	for seq := range px.instances {
+		if seq < min {
+			delete(px.instances, seq)
+		}
+	}
+}
+
+//
+// the application wants to know the
+// highest instance sequence known to
+// this peer.
+//
+func (px *Paxos) Max() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.max
+}
+
+//
+// Min() should return one more than the minimum among z_i,
+// where z_i is the highest number ever passed
+// to Done() on peer i. A peer's z_i is -1 if it has
+// never called Done().
+//
+// Paxos can forget all instances below Min(), since
+// every peer has said it is done with them. A peer
+// that is down holds Min() back until it comes back.
+//
+func (px *Paxos) Min() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.minLocked()
+}
+
+func (px *Paxos) minLocked() int {
+	min := px.done[px.me]
+	for _, d := range px.done {
+		if d < min {
+			min = d
+		}
+	}
+	return min + 1
+}
+
+//
+// the application wants to know whether this
+// peer thinks an instance has been decided,
+// and if so what the agreed value is. Status()
+// should just inspect the local peer state;
+// it should not contact other Paxos peers.
+//
+func (px *Paxos) Status(seq int) (Fate, interface{}) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if seq < px.minLocked() {
+		return Forgotten, nil
+	}
+	ins, ok := px.instances[seq]
+	if ok && ins.decided {
+		return Decided, ins.v
+	}
+	return Pending, nil
+}
+
+//
+// send an RPC to peer i. messages to ourselves are
+// handled locally rather than through the network.
+//
+func (px *Paxos) call(i int, rpcname string, args interface{}, reply interface{}) bool {
+	if i == px.me {
+		var err error
+		switch rpcname {
+		case "Paxos.Prepare":
+			err = px.Prepare(args.(*PrepareArgs), reply.(*PrepareReply))
+		case "Paxos.Accept":
+			err = px.Accept(args.(*AcceptArgs), reply.(*AcceptReply))
+		case "Paxos.Decided":
+			err = px.Decided(args.(*DecidedArgs), reply.(*DecidedReply))
+		}
+		return err == nil
+	}
+	return call(px.peers[i], rpcname, args, reply)
+}
+
+//
+// the application wants to create a paxos peer.
+// the ports of all the paxos peers (including this one)
+// are in peers[]. this server's port is peers[me].
+// the peer's RPC handlers are registered on rpcs, which
+// the application serves on its own listener. the peer
+// stops proposing once term is closed.
+//
+func Make(peers []string, me int, rpcs *rpc.Server, term <-chan interface{}) *Paxos {
+	px := &Paxos{}
+	px.dead = term
+	px.peers = peers
+	px.me = me
+	px.instances = make(map[int]*instance)
+	px.done = make([]int, len(peers))
+	for i := range px.done {
+		px.done[i] = -1
+	}
+	px.max = -1
+	px.horizon = -1
+	px.voted = make([]bool, len(peers))
+
+	rpcs.Register(px)
+	return px
+}
@@ -0,0 +1,251 @@
+package paxos
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "px-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+// start a paxos peer serving RPCs on its own listener.
+func startPeer(peers []string, me int, term chan interface{}) *Paxos {
+	rpcs := rpc.NewServer()
+	px := Make(peers, me, rpcs, term)
+
+	os.Remove(peers[me])
+	l, e := net.Listen("unix", peers[me])
+	if e != nil {
+		panic(e)
+	}
+	go func() {
+		<-term
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return px
+}
+
+func makePeers(tag string, n int) ([]*Paxos, []chan interface{}) {
+	var peers []string
+	for i := 0; i < n; i++ {
+		peers = append(peers, port(tag, i))
+	}
+	pxa := make([]*Paxos, n)
+	terms := make([]chan interface{}, n)
+	for i := 0; i < n; i++ {
+		terms[i] = make(chan interface{})
+		pxa[i] = startPeer(peers, i, terms[i])
+	}
+	return pxa, terms
+}
+
+func cleanup(terms []chan interface{}) {
+	for i := range terms {
+		select {
+		case <-terms[i]:
+		default:
+			close(terms[i])
+		}
+	}
+}
+
+// how many peers think seq is decided. fails if they disagree.
+func ndecided(t *testing.T, pxa []*Paxos, seq int) int {
+	count := 0
+	var v interface{}
+	for i := range pxa {
+		if pxa[i] == nil {
+			continue
+		}
+		fate, v1 := pxa[i].Status(seq)
+		if fate == Decided {
+			if count > 0 && v != v1 {
+				t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
+					seq, i, v, v1)
+			}
+			count++
+			v = v1
+		}
+	}
+	return count
+}
+
+func waitn(t *testing.T, pxa []*Paxos, seq int, wanted int) {
+	to := 10 * time.Millisecond
+	for iters := 0; iters < 30; iters++ {
+		if ndecided(t, pxa, seq) >= wanted {
+			break
+		}
+		time.Sleep(to)
+		if to < time.Second {
+			to *= 2
+		}
+	}
+	nd := ndecided(t, pxa, seq)
+	if nd < wanted {
+		t.Fatalf("too few decided; seq=%v ndecided=%v wanted=%v", seq, nd, wanted)
+	}
+}
+
+func TestBasic(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa, terms := makePeers("basic", npaxos)
+	defer cleanup(terms)
+
+	fmt.Printf("Test: Single proposer ...\n")
+
+	pxa[0].Start(0, "hello")
+	waitn(t, pxa, 0, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Many proposers, same value ...\n")
+
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(1, 77)
+	}
+	waitn(t, pxa, 1, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Many proposers, different values ...\n")
+
+	pxa[0].Start(2, 100)
+	pxa[1].Start(2, 101)
+	pxa[2].Start(2, 102)
+	waitn(t, pxa, 2, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Out-of-order instances ...\n")
+
+	pxa[0].Start(7, 700)
+	pxa[0].Start(6, 600)
+	pxa[1].Start(5, 500)
+	waitn(t, pxa, 7, npaxos)
+	pxa[0].Start(4, 400)
+	pxa[1].Start(3, 300)
+	waitn(t, pxa, 6, npaxos)
+	waitn(t, pxa, 5, npaxos)
+	waitn(t, pxa, 4, npaxos)
+	waitn(t, pxa, 3, npaxos)
+
+	if pxa[0].Max() != 7 {
+		t.Fatalf("wrong Max()")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestForget(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 3
+	pxa, terms := makePeers("forget", npaxos)
+	defer cleanup(terms)
+
+	fmt.Printf("Test: Forgetting ...\n")
+
+	for i := 0; i < npaxos; i++ {
+		if pxa[i].Min() > 0 {
+			t.Fatalf("wrong initial Min() %v", pxa[i].Min())
+		}
+	}
+
+	pxa[0].Start(0, "00")
+	pxa[1].Start(1, "11")
+	pxa[2].Start(2, "22")
+	waitn(t, pxa, 0, npaxos)
+	waitn(t, pxa, 1, npaxos)
+	waitn(t, pxa, 2, npaxos)
+
+	// Min() stays put until everyone has called Done()
+	pxa[0].Done(0)
+	pxa[1].Done(1)
+	for i := 0; i < npaxos; i++ {
+		if pxa[i].Min() > 0 {
+			t.Fatalf("Min() %v advanced before all peers called Done()", pxa[i].Min())
+		}
+	}
+
+	pxa[2].Done(1)
+	pxa[0].Done(1)
+
+	// the Done() values travel on the next agreements
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(3+i, "xx")
+	}
+	for i := 0; i < npaxos; i++ {
+		waitn(t, pxa, 3+i, npaxos)
+	}
+
+	for i := 0; i < npaxos; i++ {
+		if pxa[i].Min() != 2 {
+			t.Fatalf("peer %v: wanted Min() 2, got %v", i, pxa[i].Min())
+		}
+		fate, _ := pxa[i].Status(1)
+		if fate != Forgotten {
+			t.Fatalf("peer %v did not forget instance 1", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMinority(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npaxos = 5
+	pxa, terms := makePeers("minority", npaxos)
+	defer cleanup(terms)
+
+	fmt.Printf("Test: Majority decides with a minority down ...\n")
+
+	close(terms[3])
+	close(terms[4])
+	pxa[3] = nil
+	pxa[4] = nil
+
+	pxa[0].Start(0, "x")
+	waitn(t, pxa, 0, 3)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: No decision without a majority ...\n")
+
+	close(terms[2])
+	pxa[2] = nil
+
+	pxa[1].Start(1, "y")
+	time.Sleep(time.Second)
+	if ndecided(t, pxa, 1) != 0 {
+		t.Fatalf("decided with only two of five peers")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
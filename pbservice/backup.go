@@ -0,0 +1,242 @@
+package pbservice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+)
+
+//
+// Backups.
+//
+// An admin asks the primary for a Backup: a copy of the store and
+// the cache of results as of the last entry the primary applied,
+// taken in run_channels so nothing changes while it is made. The
+// reply waits for that entry to commit, so a backup only ever holds
+// writes that can no longer be lost. It says which view and LSN it
+// is as of.
+//
+// WriteBackup saves a backup to a file framed as
+//
+//   [8 byte magic "pbbackup"][4 byte format version][4 byte crc32 of payload][payload]
+//
+// where the payload is a gob-encoded Backup. ReadBackup refuses a
+// version newer than backupVersion, and a corrupt payload.
+//
+// To seed a fresh cluster from a file, start it as usual and have
+// a Clerk Restore it; the Clerk finds the primary through the
+// viewservice, and sends the backup over in pages the way a primary
+// sends its state to a new backup (see transfer.go). A primary that
+// has never applied a write collects the pages off to the side and
+// then switches over to them, under an LSN of its own, and saves a
+// snapshot. Rather than log the whole backup it starts its streams
+// over, so the servers downstream get the new state in pages too,
+// and the reply waits until they have it. The cache of results
+// comes along, so a client of the old cluster that resends a
+// mutation the backup has is not applied twice. Sharded groups are
+// not backed up this way, since a group's shards move.
+//
+
+const (
+	backupMagic   = "pbbackup"
+	backupVersion = 1 // bump when a Backup changes in a way older code cannot read
+)
+
+var errBackupCorrupt = errors.New("pbservice: corrupt backup file")
+
+// Backup() sends the req through the channel, like Operation()
+func (pb *PBServer) Backup(args BackupArgs, reply *BackupReply) error {
+	req := &backupReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+	}
+	pb.impl.backup_chan <- req
+	<-req.done
+	return nil
+}
+
+//
+// what backup() does (runs in run_channels goroutine). returns the
+// LSN that has to commit before the reply goes out, 0 for none.
+//
+func (pb *PBServer) backupImpl(args *BackupArgs, reply *BackupReply) int64 {
+	if !pb.admit(false) {
+		reply.Err = ErrWrongServer
+		return 0
+	}
+	if pb.impl.ctrl != nil {
+		reply.Err = ErrWrongGroup
+		return 0
+	}
+
+	b := Backup{
+		Viewnum:  pb.impl.view.Viewnum,
+		LSN:      pb.impl.lsn,
+		Taken:    time.Now(),
+		KVStore:  pb.impl.kv.scan("", "", pb.impl.kv.size()),
+		Versions: pb.impl.kv.versions(),
+		Rev:      pb.impl.kv.rev,
+		Forgot:   pb.impl.kv.forgot,
+		Expires:  make(map[string]time.Time),
+	}
+	for client, cr := range pb.impl.results {
+		b.OpCache = append(b.OpCache, makeResult(client, cr))
+	}
+	for key, deadline := range pb.impl.expires {
+		b.Expires[key] = deadline
+	}
+	reply.Err = OK
+	reply.Backup = b
+	return pb.impl.lsn
+}
+
+// Restore() sends the req through the channel, like Operation()
+func (pb *PBServer) Restore(args RestoreArgs, reply *RestoreReply) error {
+	req := &restoreReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+	}
+	pb.impl.restore_chan <- req
+	<-req.done
+	return nil
+}
+
+//
+// what restore() does (runs in run_channels goroutine). returns the
+// LSN that has to commit before the reply goes out, 0 for none.
+//
+func (pb *PBServer) restoreImpl(args *RestoreArgs, reply *RestoreReply) int64 {
+	if !pb.admit(false) {
+		reply.Err = ErrWrongServer
+		return 0
+	}
+	if pb.impl.ctrl != nil {
+		reply.Err = ErrWrongGroup
+		return 0
+	}
+
+	pb.ackResults(args.Client, args.Acked)
+	cached, lsn, ok := pb.cachedResult(args.Client, args.SeqNo)
+	if ok {
+		reply.Err = cached.Err
+		reply.Next = args.Page.Offset + len(args.Page.KVStore) + len(args.Page.OpCache)
+		return lsn
+	}
+	//a resent last page finds its own result, among the restored ones
+
+	if pb.impl.kv.rev != 0 || pb.impl.kv.size() != 0 || len(pb.impl.results) != 0 {
+		reply.Err = ErrNotEmpty
+		return 0
+	}
+	next, last := pb.collect(&pb.impl.restoring, &args.Page)
+	reply.Err = OK
+	reply.Next = next
+	if !last {
+		return 0
+	}
+
+	pb.switchTo(pb.impl.restoring, &args.Page)
+	pb.impl.restoring = nil
+	pb.impl.lsn++
+	pb.impl.stamp = time.Now()
+	pb.impl.logview = pb.impl.view.Viewnum
+	pb.ackResults(args.Client, args.Acked)
+	pb.recordResult(args.Client, args.SeqNo, OpReply{Err: OK})
+	pb.resetChanges(pb.impl.kv.rev)
+	pb.saveSnapshot()
+	//rather than keep the whole backup in the wal
+	pb.restartStreams()
+	pb.checkTransfer()
+	pb.advance()
+	//with nobody downstream it is committed already
+	return pb.impl.lsn
+}
+
+// b as a snapshot to send in pages, like our state to a new backup (see transfer.go)
+func (b *Backup) transfer() *transfer {
+	t := &transfer{
+		version: time.Now().UnixNano(),
+		lsn:     b.LSN,
+		pairs:   b.KVStore,
+		cache:   b.OpCache,
+		expires: b.Expires,
+		history: make(map[string][]version),
+		gone:    make(map[string][]version),
+		rev:     b.Rev,
+		forgot:  b.Forgot,
+	}
+	kept := make(map[string]bool)
+	for _, kv := range b.KVStore {
+		kept[kv.Key] = true
+	}
+	for key, vs := range b.Versions {
+		if kept[key] {
+			t.history[key] = vs
+		} else {
+			t.gone[key] = vs
+		}
+	}
+	return t
+}
+
+// save b to a file at path, replacing whatever is there atomically
+func WriteBackup(path string, b Backup) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(b); err != nil {
+		return err
+	}
+
+	hdr := make([]byte, len(backupMagic)+8)
+	copy(hdr, backupMagic)
+	binary.LittleEndian.PutUint32(hdr[len(backupMagic):], backupVersion)
+	binary.LittleEndian.PutUint32(hdr[len(backupMagic)+4:], crc32.ChecksumIEEE(payload.Bytes()))
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(hdr, payload.Bytes()...)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, path)
+}
+
+// read back a backup saved by WriteBackup
+func ReadBackup(path string) (Backup, error) {
+	var b Backup
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return b, err
+	}
+	n := len(backupMagic)
+	if len(data) < n+8 || string(data[:n]) != backupMagic {
+		return b, errBackupCorrupt
+	}
+	version := binary.LittleEndian.Uint32(data[n:])
+	if version > backupVersion {
+		return b, fmt.Errorf("pbservice: backup format version %d, we only know up to %d",
+			version, backupVersion)
+	}
+	payload := data[n+8:]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[n+4:]) {
+		return b, errBackupCorrupt
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&b); err != nil {
+		return b, errBackupCorrupt
+	}
+	return b, nil
+}
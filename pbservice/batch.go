@@ -0,0 +1,144 @@
+package pbservice
+
+import (
+	"log"
+	"time"
+)
+
+//
+// Batches.
+//
+// A Clerk in batching mode (see SetBatching) holds on to the
+// mutations its goroutines make for a moment, and sends whatever
+// has piled up in one Batch RPC, one batch at a time. The primary
+// decides each op against the database as the ops before it in the
+// batch leave it, then logs and replicates them all as one entry,
+// so the whole batch costs a single trip to the backups.
+//
+// Each op keeps its own SeqNo and gets its own result: a resent
+// batch finds the ops it already applied in the duplicate table
+// (see dedup.go), and only the rest go into a new entry.
+//
+
+// can an op go in a batch?
+func batchable(op Op) bool {
+	switch op {
+	case PUT, APPEND, DELETE, CAS, PUTIFABSENT:
+		return true
+	}
+	return false
+}
+
+// Batch() sends the req through the channel, like Operation()
+func (pb *PBServer) Batch(args BatchArgs, reply *BatchReply) error {
+	req := &batchReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+	}
+	pb.impl.batch_chan <- req
+	<-req.done
+	return nil
+}
+
+//
+// what batch() does (runs in run_channels goroutine). returns the
+// LSN that has to commit before the reply goes out, 0 for none.
+//
+func (pb *PBServer) batchImpl(args *BatchArgs, reply *BatchReply) int64 {
+	if !pb.admit(false) || !pb.expireDue() {
+		reply.Err = ErrWrongServer
+		return 0
+	}
+
+	reply.Err = OK
+	reply.Replies = make([]OpReply, len(args.Ops))
+	var ops []OpArgs
+	var results []OpReply
+	var lsn int64
+	written := make(map[string]*string) // what the ops so far leave each key holding, nil if deleted
+	get := func(key string) (string, bool) {
+		v, ok := written[key]
+		if !ok {
+			return pb.impl.kv.get(key)
+		}
+		if v == nil {
+			return "", false
+		}
+		return *v, true
+	}
+
+	for i := range args.Ops {
+		op := &args.Ops[i]
+		if !batchable(op.Op) {
+			reply.Replies[i] = OpReply{Err: ErrWrongServer}
+			continue
+		}
+		if !pb.owns(op.Key) {
+			reply.Replies[i] = OpReply{Err: ErrWrongGroup}
+			continue
+		}
+
+		pb.ackResults(op.Client, op.Acked)
+		cached, clsn, ok := pb.cachedResult(op.Client, op.SeqNo)
+		if ok {
+			reply.Replies[i] = cached
+			if clsn > lsn {
+				lsn = clsn
+			}
+			continue
+		}
+
+		result := decideWith(op, get)
+		cur, _ := get(op.Key)
+		switch {
+		case op.Op == PUT:
+			written[op.Key] = &op.Value
+		case op.Op == APPEND:
+			v := cur + op.Value
+			written[op.Key] = &v
+		case op.Op == DELETE && result.Err == OK:
+			written[op.Key] = nil
+		case result.Err == OK:
+			written[op.Key] = &op.Value
+		}
+		//CAS and PUTIFABSENT store Value if they succeed
+		reply.Replies[i] = result
+		ops = append(ops, *op)
+		results = append(results, result)
+	}
+
+	if len(ops) == 0 {
+		return lsn
+	}
+	lsn, ok := pb.submit(ReplicateArgs{Kind: entryBatch, Batch: ops, Results: results})
+	if !ok {
+		reply.Err = ErrWrongServer
+		return 0
+	}
+	return lsn
+}
+
+// log a batch and then apply it, like commitOp()
+func (pb *PBServer) commitBatch(ops []OpArgs, results []OpReply) bool {
+	deadlines := make([]time.Time, len(ops))
+	for i := range ops {
+		deadlines[i] = deadlineFor(&ops[i])
+	}
+	err := pb.impl.wal.appendEntry(walEntry{Kind: entryBatch, Batch: ops,
+		Replies: results, Deadlines: deadlines})
+	if err != nil {
+		log.Printf("%s: wal append: %v\n", pb.me, err)
+		return false
+	}
+	pb.applyBatch(ops, results, deadlines)
+	pb.compact()
+	return true
+}
+
+// apply the ops of a batch in order (also used for wal replay)
+func (pb *PBServer) applyBatch(ops []OpArgs, results []OpReply, deadlines []time.Time) {
+	for i := range ops {
+		pb.applyOp(&ops[i], results[i], deadlines[i])
+	}
+}
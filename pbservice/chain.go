@@ -0,0 +1,106 @@
+package pbservice
+
+//
+// Chain replication.
+//
+// When the view says so (View.Chain), the primary and the backups
+// form a chain, in order. Writes come in at the head (the primary),
+// which decides their outcome like a primary always does; every
+// server applies a write, streams it on to its successor, and acks
+// it upstream once the successor has (see pipeline.go), so by the
+// time the head answers the client, the whole chain has applied the
+// write.
+// Gets and Scans go to the tail instead of the primary.
+//
+// So instead of the primary fanning out to every backup, each
+// server talks to one successor, and sends it its state when it
+// joins (see transfer.go). A server only answers reads as the tail
+// once its predecessor has sent it everything; while it is being
+// filled, writes wait for it rather than commit without it, since
+// whatever the head acknowledges must already be readable at the
+// tail.
+//
+
+// where in the chain we are: predecessor and successor ("" for none)
+func (pb *PBServer) neighbours() (string, string) {
+	chain := append([]string{pb.impl.view.Primary}, pb.impl.view.Backups...)
+	for i, server := range chain {
+		if server != pb.me {
+			continue
+		}
+		pred, succ := "", ""
+		if i > 0 {
+			pred = chain[i-1]
+		}
+		if i+1 < len(chain) {
+			succ = chain[i+1]
+		}
+		return pred, succ
+	}
+	return "", ""
+}
+
+// the server whose mutations we apply, "" if we decide our own
+func (pb *PBServer) upstream() string {
+	if pb.impl.view.Chain {
+		pred, _ := pb.neighbours()
+		return pred
+	}
+	if pb.impl.view.IsBackup(pb.me) {
+		return pb.impl.view.Primary
+	}
+	return ""
+}
+
+// the servers we pass mutations on to
+func (pb *PBServer) downstream() []string {
+	if pb.impl.view.Chain {
+		_, succ := pb.neighbours()
+		if succ == "" {
+			return nil
+		}
+		return []string{succ}
+	}
+	if pb.me == pb.impl.view.Primary {
+		return pb.impl.view.Backups
+	}
+	return nil
+}
+
+// should we answer a client's Get or Scan?
+func (pb *PBServer) servesReads() bool {
+	if !pb.impl.view.Chain {
+		return pb.me == pb.impl.view.Primary
+	}
+	if pb.me != pb.impl.view.Tail() {
+		return false
+	}
+	return pb.me == pb.impl.view.Primary || (pb.impl.fed_by != "" && pb.impl.fed_by == pb.upstream())
+}
+
+//
+// as a link in the chain, check that our synced successor still
+// has our state; it forgets it if it may have dropped out of the
+// chain for a while, and then needs it sent again.
+//
+func (pb *PBServer) probeSuccessor() {
+	_, succ := pb.neighbours()
+	s := pb.impl.streams[succ]
+	if !pb.impl.view.Chain || s == nil || !s.synced || s.probing {
+		return
+	}
+	s.probing = true
+	go pb.probe(s, PushArgs{View: pb.impl.view, Source: pb.me, Probe: true})
+}
+
+// runs in its own goroutine: ask s's backup if it still has our state, and tell run_channels
+func (pb *PBServer) probe(s *stream, args PushArgs) {
+	var reply PushReply
+	ok := callCreds(pb.creds, s.backup, "PBServer.Push", &args, &reply)
+	event := streamProbed
+	if ok && reply.Err == ErrWrongServer {
+		event = streamRejected
+	}
+	//a stream that starts over sends the snapshot again
+	pb.streamEvent(s, event, 0)
+}
@@ -1,13 +1,15 @@
 package pbservice
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
-	"net/rpc"
+	"math/rand"
 	"strconv"
 	"sync"
 	"time"
 
+	"umich.edu/eecs491/proj2/transport"
 	"umich.edu/eecs491/proj2/viewservice"
 )
 
@@ -33,11 +35,65 @@ func nameInitialize() {
 	})
 }
 
+// What the Ctx methods return when they give up. If ctx is
+// cancelled instead, they return ctx.Err(). A write that gives up
+// may or may not have taken effect.
+var (
+	ErrNoPrimary = errors.New("pbservice: no primary in the current view")
+	ErrTimeout   = errors.New("pbservice: primary did not answer in time")
+)
+
+// What GetAt returns for a revision the servers no longer keep, or
+// have not got to yet. A Watcher stops with ErrRevCompacted if the
+// primary no longer has the changes it was waiting for.
+var (
+	ErrRevCompacted = errors.New("pbservice: that revision is no longer kept")
+	ErrRevAhead     = errors.New("pbservice: that revision has not happened yet")
+)
+
+// What Backup and Restore return if the service is sharded, and
+// what Restore returns if the cluster already has data.
+var (
+	ErrBackupSharded   = errors.New("pbservice: sharded groups are not backed up")
+	ErrClusterNotEmpty = errors.New("pbservice: the cluster already has data")
+)
+
+// how far past the last SeqNo it has every reply for a Clerk may
+// number new operations, which bounds what the servers keep for it
+// (see dedup.go)
+const clerkWindow = 64
+
+//
+// A Clerk is safe to use from many goroutines at once, and each of
+// them may have operations in flight (see GetAsync), up to
+// clerkWindow SeqNos past the oldest one not yet done.
+//
 type Clerk struct {
 	me        string
-	seqno     int
 	vs       *viewservice.Clerk
+	creds     *transport.Creds // nil for no TLS
+	vsmu      sync.Mutex // one viewservice Get at a time
+	mu        sync.Mutex // guards everything below
+	seqno     int
+	acked     int    // we have the replies up through this SeqNo
+	done      map[int]bool // SeqNos after acked whose replies we have
+	advanced  chan struct{} // closed when acked moves on
 	primary   string
+	tail      string // where reads go: the primary, or the tail of a chain
+	backups   []string // where stale reads may go
+	lsn       int64  // log entry of our latest write (see GetStale)
+	window    time.Duration // how long the first op of a batch waits for others, 0 for no batching
+	batchmax  int    // most ops in a batch
+	queue     []*batchOp // mutations waiting for the next batch
+	sending   bool   // whether sendBatches is running
+	full      chan struct{} // tells sendBatches not to wait for more
+}
+
+// a mutation waiting in the Clerk's queue, or in a batch on the wire
+type batchOp struct {
+	args  OpArgs
+	reply OpReply
+	done  chan struct{} // closed once reply is in
 }
 
 
@@ -52,19 +108,117 @@ func MakeClerk(vshost string, me string) *Clerk {
 		ck.me = me
 	}
 	ck.seqno = 0
+	ck.done = make(map[int]bool)
+	ck.advanced = make(chan struct{})
+	ck.full = make(chan struct{}, 1)
 	ck.vs = viewservice.MakeClerk(me, vshost)
 	ck.primary = ""
 
 	return ck
 }
 
+//
+// a Clerk that talks to the servers and the viewservice over TLS
+// (see transport). the servers know it by the name in its
+// certificate.
+//
+func MakeClerkWithCreds(vshost string, me string, creds *transport.Creds) *Clerk {
+	ck := MakeClerk(vshost, me)
+	ck.creds = creds
+	ck.vs = viewservice.MakeClerkWithCreds(creds.Name(), vshost, creds)
+	return ck
+}
+
 func (ck *Clerk) refreshPrimary() {
+	ck.refreshPrimaryCtx(context.Background())
+}
+
+// refreshPrimary, giving up once ctx is done
+func (ck *Clerk) refreshPrimaryCtx(ctx context.Context) error {
 	run := true
 	for run {
-		time.Sleep(viewservice.PingInterval)
-		ck.primary = ck.vs.Primary()
+		select {
+		case <-time.After(viewservice.PingInterval):
+		case <-ctx.Done():
+			if ck.currentPrimary() != "" {
+				return ctxErr(ctx)
+			}
+			//the last view we got named no primary
+			if ctx.Err() == context.Canceled {
+				return ctx.Err()
+			}
+			return ErrNoPrimary
+		}
+		ck.vsmu.Lock()
+		view, _ := ck.vs.Get()
+		ck.vsmu.Unlock()
+		ck.mu.Lock()
+		ck.primary = view.Primary
+		ck.tail = view.Primary
+		ck.backups = view.Backups
+		if view.Chain {
+			ck.tail = view.Tail()
+		}
 		run = (ck.primary == "")
+		ck.mu.Unlock()
+	}
+	return nil
+}
+
+// the primary we know of, "" if none
+func (ck *Clerk) currentPrimary() string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.primary
+}
+
+//
+// number a new operation: its SeqNo, and the SeqNo we have every
+// reply up through, to send as Acked. waits while the new SeqNo
+// would be more than clerkWindow past that. the caller must
+// finish the SeqNo once it has the reply, or gives up.
+//
+func (ck *Clerk) begin(ctx context.Context) (int, int, error) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	for ck.seqno+1 > ck.acked+clerkWindow {
+		advanced := ck.advanced
+		ck.mu.Unlock()
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			ck.mu.Lock()
+			return 0, 0, ctxErr(ctx)
+		}
+		ck.mu.Lock()
+	}
+	ck.seqno = ck.seqno + 1
+	return ck.seqno, ck.acked, nil
+}
+
+// we have the reply to seqno, or have given up on it
+func (ck *Clerk) finish(seqno int) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.done[seqno] = true
+	moved := false
+	for ck.done[ck.acked+1] {
+		delete(ck.done, ck.acked+1)
+		ck.acked = ck.acked + 1
+		moved = true
+	}
+	if moved {
+		close(ck.advanced)
+		ck.advanced = make(chan struct{})
+	}
+}
+
+// why an operation that ran out of ctx gave up
+func ctxErr(ctx context.Context) error {
+	if ctx.Err() == context.Canceled {
+		return ctx.Err()
 	}
+	return ErrTimeout
 }
 
 
@@ -81,37 +235,117 @@ func (ck *Clerk) refreshPrimary() {
 //
 func (ck *Clerk) doOperation(op Op, key string,
 	value string, reply *OpReply) {
+	ck.doOperationArgs(OpArgs{Op: op, Key: key, Value: value}, reply)
+}
+
+//
+// Perform an operation whose arguments go beyond a key and
+// value. Fills in the client, sequence #, ack and source.
+//
+func (ck *Clerk) doOperationArgs(args OpArgs, reply *OpReply) {
+	ck.doOperationCtx(context.Background(), args, reply)
+}
+
+// doOperationArgs, giving up once ctx is done
+func (ck *Clerk) doOperationCtx(ctx context.Context, args OpArgs, reply *OpReply) error {
+	err := ck.number(ctx, &args)
+	if err != nil {
+		return err
+	}
+	defer ck.finish(args.SeqNo)
+	return ck.send(ctx, args, reply)
+}
+
+// fill in the client, sequence #, ack and source (see begin)
+func (ck *Clerk) number(ctx context.Context, args *OpArgs) error {
+	seqno, acked, err := ck.begin(ctx)
+	if err != nil {
+		return err
+	}
+	args.Client = ck.me
+	args.SeqNo = seqno
+	args.Acked = acked
+	args.Source = ck.me
+	return nil
+}
+
+// send an operation, already numbered, to the primary
+func (ck *Clerk) send(ctx context.Context, args OpArgs, reply *OpReply) error {
+	op := ck.enqueue(args)
+	if op != nil {
+		return ck.await(ctx, op, reply)
+	}
 
 	// ask the viewservice for the primary if not already cached
-	if ck.primary == "" {
-		ck.refreshPrimary()
+	if ck.currentPrimary() == "" {
+		err := ck.refreshPrimaryCtx(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Increment sequence number
-	ck.seqno = ck.seqno + 1
+	return ck.issueCtx(ctx, "PBServer.Operation", args, reply, args.Op == GET || args.Op == SCAN)
+}
 
-	// Create the argument/reply structs
-	args := OpArgs{Op: op, Key: key, Value: value,
-		Client: ck.me, SeqNo: ck.seqno, Source: ck.me}
+//
+// Send an RPC to the primary (or for a read, the tail of the
+// chain), over and over, until the (current) primary gives an
+// answer other than ErrWrongServer.
+//
+func (ck *Clerk) issue(rpcname string, args interface{}, reply *OpReply, read bool) {
+	ck.issueCtx(context.Background(), rpcname, args, reply, read)
+}
 
+// issue, giving up once ctx is done
+func (ck *Clerk) issueCtx(ctx context.Context, rpcname string, args interface{},
+	reply *OpReply, read bool) error {
 	for true {
 		// Issue until RPC succeeds
+		var r OpReply
 		for {
-			ok := call(ck.primary, "PBServer.Operation", args, &reply)
+			ck.mu.Lock()
+			server := ck.primary
+			if read {
+				server = ck.tail
+			}
+			ck.mu.Unlock()
+			r = OpReply{}
+			ok := callCtx(ctx, ck.creds, server, rpcname, args, &r)
 			if ok {
 				break
 			}
-			log.Printf("DoOp RPC issued to %s failed\n", ck.primary)
-			time.Sleep(viewservice.PingInterval)
-			ck.refreshPrimary()
+			if ctx.Err() != nil {
+				return ctxErr(ctx)
+			}
+			log.Printf("DoOp RPC issued to %s failed\n", server)
+			select {
+			case <-time.After(viewservice.PingInterval):
+			case <-ctx.Done():
+				return ctxErr(ctx)
+			}
+			err := ck.refreshPrimaryCtx(ctx)
+			if err != nil {
+				return err
+			}
 		}
-		
-		if reply.Err == ErrWrongServer {
-			ck.refreshPrimary()
+		//a fresh reply each time, a call we gave up on may still fill in its own
+
+		if r.Err == ErrWrongServer {
+			err := ck.refreshPrimaryCtx(ctx)
+			if err != nil {
+				return err
+			}
 		} else {
-			return
+			*reply = r
+			ck.mu.Lock()
+			if !read && reply.LSN > ck.lsn {
+				ck.lsn = reply.LSN
+			}
+			ck.mu.Unlock()
+			return nil
 		}
 	}
+	return nil
 }
 
 
@@ -119,41 +353,685 @@ func (ck *Clerk) doOperation(op Op, key string,
 // Get a value for a key
 //
 func (ck *Clerk) Get(key string) string {
+	value, _ := ck.GetCtx(context.Background(), key)
+	return value
+}
+
+//
+// like Get, but give up once ctx is done: with ErrNoPrimary if
+// there was no primary to ask, else ErrTimeout (or ctx.Err() if
+// ctx was cancelled)
+//
+func (ck *Clerk) GetCtx(ctx context.Context, key string) (string, error) {
 
 	var reply OpReply
 
 	log.Printf("%s: Getting value for key %s\n", ck.me, key)
-	ck.doOperation(GET, key, "", &reply)
+	err := ck.doOperationCtx(ctx, OpArgs{Op: GET, Key: key}, &reply)
+	if err != nil {
+		return "", err
+	}
 
 	if reply.Err == ErrNoKey {
-		return ""
+		return "", nil
 	} else {
-		return reply.Value
+		return reply.Value, nil
+	}
+}
+
+//
+// Get a value for a key, and the revision of the write that gave
+// it that value (0 if there is no key). Every write moves the store
+// on to a new revision, so a later write of the key has a greater
+// one (see Cond for checking it has not changed).
+//
+func (ck *Clerk) GetRev(key string) (string, int64) {
+	var reply OpReply
+	ck.doOperation(GET, key, "", &reply)
+	if reply.Err == ErrNoKey {
+		return "", 0
+	}
+	return reply.Value, reply.Rev
+}
+
+//
+// the value key had as of revision rev, whether it existed then,
+// and the revision of the write that gave it that value. The
+// servers keep as many earlier values as their Options say; for
+// older ones GetAt returns ErrRevCompacted.
+//
+func (ck *Clerk) GetAt(key string, rev int64) (string, bool, int64, error) {
+	var reply OpReply
+
+	log.Printf("%s: Getting value for key %s as of revision %v\n", ck.me, key, rev)
+	ck.doOperationArgs(OpArgs{Op: GET, Key: key, AtRev: rev}, &reply)
+
+	switch reply.Err {
+	case ErrCompacted:
+		return "", false, 0, ErrRevCompacted
+	case ErrNoRev:
+		return "", false, 0, ErrRevAhead
+	case ErrNoKey:
+		return "", false, reply.Rev, nil
+	}
+	return reply.Value, true, reply.Rev, nil
+}
+
+//
+// Get a value for a key, possibly from a backup, and possibly up
+// to maxStaleness out of date. Falls back to the primary if no
+// backup is recent enough. Use GetStaleAfter to also see our own
+// writes.
+//
+func (ck *Clerk) GetStale(key string, maxStaleness time.Duration) string {
+	value, _, _ := ck.GetStaleAfter(key, maxStaleness, 0)
+	return value
+}
+
+//
+// like GetStale, but the answer must reflect at least log entry
+// minLSN, say LastLSN() for read-your-writes. Also returns the
+// view # and log entry the answer reflects.
+//
+func (ck *Clerk) GetStaleAfter(key string, maxStaleness time.Duration,
+	minLSN int64) (string, uint, int64) {
+
+	if ck.currentPrimary() == "" {
+		ck.refreshPrimary()
+	}
+
+	var reply OpReply
+	ck.mu.Lock()
+	backups := ck.backups
+	ck.mu.Unlock()
+	if len(backups) > 0 {
+		args := OpArgs{Op: GET, Key: key, MaxStale: maxStaleness, MinLSN: minLSN,
+			Client: ck.me, Source: ck.me}
+		server := backups[rand.Intn(len(backups))]
+		log.Printf("%s: Getting value for key %s from backup %s\n", ck.me, key, server)
+		ok := callCreds(ck.creds, server, "PBServer.Operation", args, &reply)
+		if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+			return reply.Value, reply.Viewnum, reply.LSN
+		}
+	}
+	//spread over the backups, and only bother the primary if need be
+
+	reply = OpReply{}
+	ck.doOperation(GET, key, "", &reply)
+	return reply.Value, reply.Viewnum, reply.LSN
+}
+
+//
+// the log entry of our latest write, for GetStaleAfter
+//
+func (ck *Clerk) LastLSN() int64 {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.lsn
+}
+
+//
+// Fetch up to limit keys (and their values) with start <= key < end,
+// in key order. An empty end means no upper bound; limit <= 0 asks
+// for a page of MaxScan. Also returns the start of the next page,
+// "" once the range is exhausted; pass it back as start to continue.
+//
+func (ck *Clerk) Scan(start string, end string, limit int) ([]KeyValue, string) {
+
+	var reply OpReply
+
+	log.Printf("%s: Scanning keys from %s to %s\n", ck.me, start, end)
+	ck.doOperationArgs(OpArgs{Op: SCAN, Key: start, End: end,
+		Limit: limit}, &reply)
+
+	return reply.Pairs, reply.Value
+}
+
+//
+// List every key that starts with prefix, in order.
+//
+func (ck *Clerk) ListPrefix(prefix string) []string {
+	var keys []string
+	end := prefixEnd(prefix)
+	start := prefix
+	for {
+		pairs, next := ck.Scan(start, end, 0)
+		for _, kv := range pairs {
+			keys = append(keys, kv.Key)
+		}
+		if next == "" {
+			return keys
+		}
+		start = next
 	}
 }
 
+// the smallest key greater than every key with the given prefix,
+// "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
 //
 // tell the primary to update key's value.
 //
 func (ck *Clerk) Put(key string, value string) {
+	ck.PutCtx(context.Background(), key, value)
+}
+
+//
+// like Put, but give up once ctx is done (see GetCtx). the Put
+// may still take effect after that.
+//
+func (ck *Clerk) PutCtx(ctx context.Context, key string, value string) error {
 
 	var reply OpReply
 
 	log.Printf("%s: Putting value %s for key %s\n", ck.me, value, key)
-	ck.doOperation(PUT, key, value, &reply)
+	return ck.doOperationCtx(ctx, OpArgs{Op: PUT, Key: key, Value: value}, &reply)
+}
+
+//
+// like Put, but the key disappears ttl after the Put, unless
+// another Put or a Delete gets to it first.
+//
+func (ck *Clerk) PutWithTTL(key string, value string, ttl time.Duration) {
+
+	var reply OpReply
+
+	log.Printf("%s: Putting value %s for key %s with ttl %v\n", ck.me, value, key, ttl)
+	ck.doOperationArgs(OpArgs{Op: PUT, Key: key, Value: value, TTL: ttl}, &reply)
 }
 
 //
 // tell the primary to append to key's value.
 //
 func (ck *Clerk) Append(key string, value string) {
+	ck.AppendCtx(context.Background(), key, value)
+}
+
+//
+// like Append, but give up once ctx is done (see GetCtx). the
+// Append may still take effect after that.
+//
+func (ck *Clerk) AppendCtx(ctx context.Context, key string, value string) error {
 
 	var reply OpReply
 
 	log.Printf("%s: Appending value %s to key %s\n", ck.me, value, key)
-	ck.doOperation(APPEND, key, value, &reply)
+	return ck.doOperationCtx(ctx, OpArgs{Op: APPEND, Key: key, Value: value}, &reply)
+}
+
+//
+// An operation in flight, from GetAsync, PutAsync or AppendAsync.
+//
+type Future struct {
+	done  chan struct{}
+	reply OpReply
+	err   error
 }
 
+// closed once the operation is done
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//
+// wait for the operation, and return what the Ctx version of it
+// would: the value for a Get ("" otherwise), and nil or why it
+// gave up
+//
+func (f *Future) Wait() (string, error) {
+	<-f.done
+	if f.err != nil || f.reply.Err == ErrNoKey {
+		return "", f.err
+	}
+	return f.reply.Value, nil
+}
+
+//
+// number an operation here, so a Clerk's operations get SeqNos in
+// the order they were started, then carry it out in the background.
+// blocks while the Clerk has too many SeqNos outstanding (see begin).
+//
+func (ck *Clerk) start(ctx context.Context, args OpArgs) *Future {
+	f := &Future{done: make(chan struct{})}
+	f.err = ck.number(ctx, &args)
+	if f.err != nil {
+		close(f.done)
+		return f
+	}
+	op := ck.enqueue(args)
+	//queued here, so batches keep the order the ops were started in
+	go func() {
+		if op != nil {
+			f.err = ck.await(ctx, op, &f.reply)
+		} else {
+			f.err = ck.send(ctx, args, &f.reply)
+		}
+		ck.finish(args.SeqNo)
+		close(f.done)
+	}()
+	return f
+}
+
+//
+// start a Get, without waiting for it (see GetCtx). the Clerk
+// may go on to other operations meanwhile.
+//
+func (ck *Clerk) GetAsync(ctx context.Context, key string) *Future {
+	log.Printf("%s: Getting value for key %s in the background\n", ck.me, key)
+	return ck.start(ctx, OpArgs{Op: GET, Key: key})
+}
+
+// start a Put, without waiting for it (see PutCtx)
+func (ck *Clerk) PutAsync(ctx context.Context, key string, value string) *Future {
+	log.Printf("%s: Putting value %s for key %s in the background\n", ck.me, value, key)
+	return ck.start(ctx, OpArgs{Op: PUT, Key: key, Value: value})
+}
+
+// start an Append, without waiting for it (see AppendCtx)
+func (ck *Clerk) AppendAsync(ctx context.Context, key string, value string) *Future {
+	log.Printf("%s: Appending value %s to key %s in the background\n", ck.me, value, key)
+	return ck.start(ctx, OpArgs{Op: APPEND, Key: key, Value: value})
+}
+
+//
+// tell the primary to remove key. returns whether the key
+// existed beforehand.
+//
+func (ck *Clerk) Delete(key string) bool {
+
+	var reply OpReply
+
+	log.Printf("%s: Deleting key %s\n", ck.me, key)
+	ck.doOperation(DELETE, key, "", &reply)
+
+	return reply.Err == OK
+}
+
+//
+// atomically set key to value, provided it currently holds
+// expected. returns whether the swap happened, and the key's
+// value afterwards ("" if the key does not exist).
+//
+func (ck *Clerk) CompareAndSwap(key string, expected string,
+	value string) (bool, string) {
+
+	var reply OpReply
+
+	log.Printf("%s: Swapping key %s from %s to %s\n", ck.me, key, expected, value)
+	ck.doOperationArgs(OpArgs{Op: CAS, Key: key, Value: value,
+		Expected: expected}, &reply)
+
+	return reply.Err == OK, reply.Value
+}
+
+//
+// set key to value only if key does not exist yet. returns
+// whether value was stored, and the key's value afterwards.
+//
+func (ck *Clerk) PutIfAbsent(key string, value string) (bool, string) {
+
+	var reply OpReply
+
+	log.Printf("%s: Putting value %s for absent key %s\n", ck.me, value, key)
+	ck.doOperation(PUTIFABSENT, key, value, &reply)
+
+	return reply.Err == OK, reply.Value
+}
+
+//
+// atomically read the keys in reads, check every cond, and if
+// they all hold apply writes in order. returns the values read
+// (from before the writes) and whether the writes were applied.
+//
+func (ck *Clerk) Transaction(reads []string, conds []Cond,
+	writes []Write) ([]string, bool) {
+
+	var reply OpReply
+
+	if ck.currentPrimary() == "" {
+		ck.refreshPrimary()
+	}
+	seqno, acked, _ := ck.begin(context.Background())
+	defer ck.finish(seqno)
+	args := TxnArgs{Reads: reads, Conds: conds, Writes: writes,
+		Client: ck.me, SeqNo: seqno, Acked: acked, Source: ck.me}
+
+	log.Printf("%s: Transaction with %d reads, %d conds, %d writes\n",
+		ck.me, len(reads), len(conds), len(writes))
+	ck.issue("PBServer.Transaction", args, &reply, false)
+
+	return reply.Values, reply.Err == OK
+}
+
+//
+// take a backup of the whole database from the primary (see
+// backup.go) and save it to path. returns the backup, which says
+// which view and LSN it is as of.
+//
+func (ck *Clerk) Backup(path string) (Backup, error) {
+	return ck.BackupCtx(context.Background(), path)
+}
+
+// like Backup, but give up once ctx is done (see GetCtx)
+func (ck *Clerk) BackupCtx(ctx context.Context, path string) (Backup, error) {
+	args := BackupArgs{Source: ck.me}
+	var reply BackupReply
+
+	log.Printf("%s: Backing up to %s\n", ck.me, path)
+	err := ck.untilPrimary(ctx, func(server string) bool {
+		reply = BackupReply{}
+		ok := callCtx(ctx, ck.creds, server, "PBServer.Backup", args, &reply)
+		return ok && reply.Err != ErrWrongServer
+	})
+	if err != nil {
+		return Backup{}, err
+	}
+
+	if reply.Err == ErrWrongGroup {
+		return Backup{}, ErrBackupSharded
+	}
+	return reply.Backup, WriteBackup(path, reply.Backup)
+}
+
+//
+// seed a fresh cluster with the backup saved at path. returns
+// ErrClusterNotEmpty, and changes nothing, if the primary has
+// already applied a write.
+//
+func (ck *Clerk) Restore(path string) error {
+	return ck.RestoreCtx(context.Background(), path)
+}
+
+//
+// like Restore, but give up once ctx is done (see GetCtx). the
+// restore may still go through after that.
+//
+func (ck *Clerk) RestoreCtx(ctx context.Context, path string) error {
+	b, err := ReadBackup(path)
+	if err != nil {
+		return err
+	}
+
+	if ck.currentPrimary() == "" {
+		ck.refreshPrimaryCtx(ctx)
+	}
+	seqno, acked, err := ck.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer ck.finish(seqno)
+
+	t := b.transfer()
+	total := len(t.pairs) + len(t.cache)
+	var reply RestoreReply
+
+	log.Printf("%s: Restoring %d keys from %s\n", ck.me, len(b.KVStore), path)
+	next := 0
+	for {
+		args := RestoreArgs{Page: t.page(next), Client: ck.me, SeqNo: seqno, Acked: acked, Source: ck.me}
+		err := ck.untilPrimary(ctx, func(server string) bool {
+			reply = RestoreReply{}
+			ok := callCtx(ctx, ck.creds, server, "PBServer.Restore", &args, &reply)
+			return ok && reply.Err != ErrWrongServer
+		})
+		if err != nil {
+			return err
+		}
+		if reply.Err != OK || reply.Next >= total {
+			break
+		}
+		next = reply.Next
+		//a new primary wants the pages from the start
+	}
+
+	ck.mu.Lock()
+	if reply.LSN > ck.lsn {
+		ck.lsn = reply.LSN
+	}
+	ck.mu.Unlock()
+	switch reply.Err {
+	case ErrNotEmpty:
+		return ErrClusterNotEmpty
+	case ErrWrongGroup:
+		return ErrBackupSharded
+	}
+	return nil
+}
+
+//
+// call the primary through try until it gets an answer, looking the
+// primary up again in between, like issueCtx for the calls that do
+// not reply with an OpReply. gives up once ctx is done.
+//
+func (ck *Clerk) untilPrimary(ctx context.Context, try func(server string) bool) error {
+	for {
+		server := ck.currentPrimary()
+		if server != "" && try(server) {
+			return nil
+		}
+		select {
+		case <-time.After(viewservice.PingInterval):
+		case <-ctx.Done():
+			return ctxErr(ctx)
+		}
+		err := ck.refreshPrimaryCtx(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+
+//
+// A stream of changes, from Watch or WatchPrefix.
+//
+type Watcher struct {
+	Events <-chan Event // closed once the watch ends, see Err
+	err    error
+}
+
+//
+// why Events was closed: ctx.Err() once the ctx passed to Watch is
+// done, or ErrRevCompacted if the changes after the last one we
+// delivered were lost, in which case Get the key afresh and watch
+// again from now.
+//
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+//
+// deliver the changes to key after revision rev (the Rev of the
+// last Event seen), or with rev 0, those from now on. Each change
+// is delivered once and in order, even across a change of primary.
+// The watch goes on until ctx is done.
+//
+func (ck *Clerk) Watch(ctx context.Context, key string, rev int64) *Watcher {
+	return ck.watch(ctx, WatchArgs{Key: key}, rev)
+}
+
+// like Watch, but for every key that starts with prefix
+func (ck *Clerk) WatchPrefix(ctx context.Context, prefix string, rev int64) *Watcher {
+	return ck.watch(ctx, WatchArgs{Key: prefix, Prefix: true}, rev)
+}
+
+func (ck *Clerk) watch(ctx context.Context, args WatchArgs, rev int64) *Watcher {
+	events := make(chan Event)
+	w := &Watcher{Events: events}
+	args.After, args.Now, args.Source = rev, rev == 0, ck.me
+	go func() {
+		defer close(events)
+		w.err = ck.runWatch(ctx, args, events)
+	}()
+	return w
+}
+
+// long-poll the primary for changes and pass them on, until ctx is done
+func (ck *Clerk) runWatch(ctx context.Context, args WatchArgs, events chan Event) error {
+	for {
+		server := ck.currentPrimary()
+		var reply WatchReply
+		ok := server != "" && callCtx(ctx, ck.creds, server, "PBServer.Watch", args, &reply)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !ok || reply.Err != OK {
+			if ok && reply.Err == ErrCompacted {
+				return ErrRevCompacted
+			}
+			select {
+			case <-time.After(viewservice.PingInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if ck.refreshPrimaryCtx(ctx) != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		for _, ev := range reply.Events {
+			if ev.Rev <= args.After {
+				continue
+			}
+			//a new primary does not resend what the old one told us
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if reply.Rev > args.After || args.Now {
+			args.After, args.Now = reply.Rev, false
+		}
+	}
+}
+
+//
+// Batch mutations (see batch.go): from now on, a Put, Append,
+// Delete, CompareAndSwap or PutIfAbsent waits up to window for
+// others to join it, and they go to the primary together, up to
+// max of them (MaxBatch if max <= 0) at once. While one batch is
+// out, the next one fills up. A window of 0 turns batching off.
+//
+func (ck *Clerk) SetBatching(window time.Duration, max int) {
+	if max <= 0 || max > MaxBatch {
+		max = MaxBatch
+	}
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.window = window
+	ck.batchmax = max
+}
+
+// queue a mutation for the next batch, nil if it does not go in one
+func (ck *Clerk) enqueue(args OpArgs) *batchOp {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.window <= 0 || !batchable(args.Op) {
+		return nil
+	}
+	op := &batchOp{args: args, done: make(chan struct{})}
+	ck.queue = append(ck.queue, op)
+	if !ck.sending {
+		ck.sending = true
+		go ck.sendBatches(ck.window)
+	}
+	if len(ck.queue) >= ck.batchmax {
+		select {
+		case ck.full <- struct{}{}:
+		default:
+		}
+	}
+	return op
+}
+
+// wait for the reply to a queued mutation, giving up once ctx is done
+func (ck *Clerk) await(ctx context.Context, op *batchOp, reply *OpReply) error {
+	select {
+	case <-op.done:
+		*reply = op.reply
+		return nil
+	case <-ctx.Done():
+		return ctxErr(ctx)
+	}
+}
+
+//
+// runs in its own goroutine while there are mutations queued:
+// send them a batch at a time, in order, until none are left
+//
+func (ck *Clerk) sendBatches(window time.Duration) {
+	select {
+	case <-time.After(window):
+	case <-ck.full:
+	}
+	//give other ops a moment to join the first one
+	for {
+		ck.mu.Lock()
+		n := len(ck.queue)
+		if n == 0 {
+			ck.sending = false
+			ck.mu.Unlock()
+			return
+		}
+		if n > ck.batchmax {
+			n = ck.batchmax
+		}
+		ops := ck.queue[:n:n]
+		ck.queue = ck.queue[n:]
+		select {
+		case <-ck.full:
+		default:
+		}
+		ck.mu.Unlock()
+		ck.sendBatch(ops)
+	}
+}
+
+//
+// send a batch to the primary, over and over, until the (current)
+// primary takes it, then hand each op its reply
+//
+func (ck *Clerk) sendBatch(ops []*batchOp) {
+	args := BatchArgs{Source: ck.me}
+	for _, op := range ops {
+		args.Ops = append(args.Ops, op.args)
+	}
+	for {
+		server := ck.currentPrimary()
+		var reply BatchReply
+		ok := server != "" && callCreds(ck.creds, server, "PBServer.Batch", args, &reply)
+		if ok && reply.Err == OK && len(reply.Replies) == len(ops) {
+			ck.mu.Lock()
+			if reply.LSN > ck.lsn {
+				ck.lsn = reply.LSN
+			}
+			ck.mu.Unlock()
+			for i, op := range ops {
+				op.reply = reply.Replies[i]
+				op.reply.Viewnum, op.reply.LSN = reply.Viewnum, reply.LSN
+				close(op.done)
+			}
+			return
+		}
+		if !ok {
+			log.Printf("Batch RPC issued to %s failed\n", server)
+			time.Sleep(viewservice.PingInterval)
+		}
+		ck.refreshPrimary()
+	}
+}
 
 
 //
@@ -172,19 +1050,22 @@ func (ck *Clerk) Append(key string, value string) {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
-	if errx != nil {
-		return false
-	}
-	defer c.Close()
+	return callCreds(nil, srv, rpcname, args, reply)
+}
 
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
-	}
+// call(), over TLS if creds is not nil, on a connection shared
+// with everyone else in the process (see transport)
+func callCreds(creds *transport.Creds, srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	return callCtx(context.Background(), creds, srv, rpcname, args, reply)
+}
 
-	fmt.Println(err)
-	return false
+// callCreds, giving up once ctx is done. the reply may still be
+// filled in after that
+func callCtx(ctx context.Context, creds *transport.Creds, srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	err := transport.Shared(creds).CallCtx(ctx, srv, rpcname, args, reply)
+	return err == nil
 }
 
 
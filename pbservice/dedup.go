@@ -0,0 +1,152 @@
+package pbservice
+
+import (
+	"time"
+)
+
+//
+// Duplicate detection.
+//
+// A Clerk numbers its operations 1, 2, 3, ..., and may have a window
+// of them outstanding at once, so they can reach us (and finish) in
+// any order. Each request says (in Acked) that the client has the
+// replies to everything up through some SeqNo; anything at or below
+// that is a stray duplicate of an op the client has moved past, and
+// is not applied again. Above it we keep the result of each mutation
+// applied, so a retry gets the same result, until Acked passes it.
+//
+// Acked travels in the log along with the op (see applyOp), so the
+// backups drop results when the primary does.
+//
+// Clients that have not been heard from in clientIdle are forgotten
+// altogether. A duplicate delayed for longer than that would be
+// applied again.
+//
+
+const clientIdle = 10 * time.Minute
+
+type clientResult struct {
+	Acked   int                 // the client has the replies up through this SeqNo
+	Replies map[int]cachedReply // mutations applied after Acked, by SeqNo
+	Seen    time.Time           // when we last heard from the client
+	LSN     int64               // the log entry of its latest mutation (see pipeline.go)
+}
+
+type cachedReply struct {
+	Reply OpReply // what the mutation returned
+	LSN   int64   // the log entry that applied it
+}
+
+// the result we handed out for an op we already applied, if any,
+// and the entry that has to commit before we hand it out again
+func (pb *PBServer) cachedResult(client string, seqno int) (OpReply, int64, bool) {
+	cr, ok := pb.impl.results[client]
+	if !ok {
+		return OpReply{}, 0, false
+	}
+	cached, ok := cr.Replies[seqno]
+	if !ok && seqno > cr.Acked {
+		return OpReply{}, 0, false
+	}
+	lsn := cr.LSN
+	if ok {
+		lsn = cached.LSN
+	}
+	if lsn > pb.impl.lsn {
+		lsn = pb.impl.lsn
+	}
+	//recovered from disk, numbered by some earlier log
+	if !ok {
+		return OpReply{Err: OK}, lsn, true
+	}
+	//an old duplicate, nobody is waiting for its reply
+	return cached.Reply, lsn, true
+}
+
+// has a mutation from client already been applied?
+func (pb *PBServer) applied(client string, seqno int) bool {
+	cr, ok := pb.impl.results[client]
+	if !ok {
+		return false
+	}
+	_, ok = cr.Replies[seqno]
+	return ok || seqno <= cr.Acked
+}
+
+// remember the result of a mutation just applied
+func (pb *PBServer) recordResult(client string, seqno int, result OpReply) {
+	cr, ok := pb.impl.results[client]
+	if !ok {
+		cr = clientResult{Replies: make(map[int]cachedReply)}
+	}
+	cr.Replies[seqno] = cachedReply{Reply: result, LSN: pb.impl.lsn}
+	cr.Seen = time.Now()
+	cr.LSN = pb.impl.lsn
+	pb.impl.results[client] = cr
+}
+
+// the client has the replies up through acked, it will not ask again
+func (pb *PBServer) ackResults(client string, acked int) {
+	cr, ok := pb.impl.results[client]
+	if !ok {
+		return
+	}
+	cr.Seen = time.Now()
+	if acked > cr.Acked {
+		cr.Acked = acked
+		for seqno := range cr.Replies {
+			if seqno <= acked {
+				delete(cr.Replies, seqno)
+			}
+		}
+	}
+	pb.impl.results[client] = cr
+}
+
+// take in results for client from another server (see transfer.go
+// and shard.go), keeping whatever we already know
+func (pb *PBServer) mergeResults(results map[string]clientResult, r Result) {
+	cr, ok := results[r.Client]
+	if !ok {
+		cr = clientResult{Replies: make(map[int]cachedReply)}
+	}
+	if r.Acked > cr.Acked {
+		cr.Acked = r.Acked
+	}
+	for seqno, reply := range r.V {
+		_, ok := cr.Replies[seqno]
+		if seqno > cr.Acked && !ok {
+			cr.Replies[seqno] = cachedReply{Reply: reply, LSN: pb.impl.lsn}
+		}
+	}
+	for seqno := range cr.Replies {
+		if seqno <= cr.Acked {
+			delete(cr.Replies, seqno)
+		}
+	}
+	cr.Seen = time.Now()
+	cr.LSN = pb.impl.lsn
+	results[r.Client] = cr
+}
+
+// our results for client, to send to another server
+func makeResult(client string, cr clientResult) Result {
+	r := Result{Client: client, Acked: cr.Acked, V: make(map[int]OpReply)}
+	for seqno, cached := range cr.Replies {
+		r.V[seqno] = cached.Reply
+	}
+	return r
+}
+
+// forget clients that have been idle for too long
+func (pb *PBServer) sweepClients() {
+	if time.Since(pb.impl.lastsweep) < clientIdle/10 {
+		return
+	}
+	pb.impl.lastsweep = time.Now()
+	for client, cr := range pb.impl.results {
+		if time.Since(cr.Seen) > clientIdle {
+			delete(pb.impl.results, client)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package pbservice
+
+import (
+	"container/heap"
+	"time"
+)
+
+//
+// Keys written with PutWithTTL expire. Only the primary decides
+// that a key has expired: it turns each expiration into an EXPIRE
+// mutation that goes to the backup and into the wal like any other
+// write, so both replicas drop the key at the same point in the
+// sequence of operations no matter how their clocks drift. A
+// backup just keeps its own deadlines around, to act on if it is
+// promoted.
+//
+// The primary reaps everything due before it handles a client
+// operation, so nobody observes a key past its deadline.
+//
+
+// a key's deadline; one per PutWithTTL, stale ones are skipped
+type expiry struct {
+	key      string
+	deadline time.Time
+}
+
+// min-heap of deadlines
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// set (or with a zero deadline, clear) the deadline for key
+func (pb *PBServer) setDeadline(key string, deadline time.Time) {
+	if deadline.IsZero() {
+		delete(pb.impl.expires, key)
+		return
+	}
+	pb.impl.expires[key] = deadline
+	heap.Push(&pb.impl.deadlines, expiry{key: key, deadline: deadline})
+}
+
+// when a write made now should expire, zero for never
+func deadlineFor(args *OpArgs) time.Time {
+	if args.Op == PUT && args.TTL > 0 {
+		return time.Now().Add(args.TTL)
+	}
+	return time.Time{}
+}
+
+//
+// as primary, expire every key whose deadline has passed.
+// false if an expiration could not be logged.
+//
+func (pb *PBServer) expireDue() bool {
+	now := time.Now()
+	for pb.impl.deadlines.Len() > 0 && !pb.impl.deadlines[0].deadline.After(now) {
+		e := pb.impl.deadlines[0]
+		deadline, ok := pb.impl.expires[e.key]
+		if !ok || !deadline.Equal(e.deadline) {
+			heap.Pop(&pb.impl.deadlines)
+			continue
+		}
+		//superseded by a later write
+
+		args := OpArgs{Op: EXPIRE, Key: e.key, Source: pb.me}
+		_, ok = pb.submit(ReplicateArgs{Kind: entryOp, Op: args, Result: OpReply{Err: OK}})
+		if !ok {
+			return false
+		}
+		heap.Pop(&pb.impl.deadlines)
+	}
+	return true
+}
+
+// has key not reached its deadline? servers other than the primary
+// (a chain's tail) may get a read before the primary expires it
+func (pb *PBServer) live(key string) bool {
+	deadline, ok := pb.impl.expires[key]
+	return !ok || deadline.After(time.Now())
+}
+
+// pairs without the keys that are past their deadline
+func (pb *PBServer) liveOnly(pairs []KeyValue) []KeyValue {
+	var kept []KeyValue
+	for _, kv := range pairs {
+		if pb.live(kv.Key) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
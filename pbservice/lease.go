@@ -0,0 +1,46 @@
+package pbservice
+
+import (
+	"time"
+)
+
+//
+// Read leases.
+//
+// Every Ping that the viewservice answers with us as primary renews
+// our lease (see viewservice.LeaseDuration): until it runs out, the
+// viewservice will not make anyone else primary. So while the lease
+// lasts, the primary answers Gets and Scans from its own state.
+//
+// Without a lease, it first makes sure that its first backup, the
+// one that would be promoted in its place, still follows it: it
+// sends a no-op down the pipeline (see pipeline.go) and answers the
+// read once that commits. A backup that has moved on to a newer view
+// turns the no-op away. With no such backup, the read fails.
+//
+
+// may we answer reads without asking anyone?
+func (pb *PBServer) leased() bool {
+	return time.Now().Before(pb.impl.lease)
+}
+
+// the LSN that has to commit before a read can be answered; 0 with
+// ErrWrongServer in reply if we cannot vouch for it
+func (pb *PBServer) readLSN(reply *OpReply) int64 {
+	if pb.me != pb.impl.view.Primary || pb.leased() {
+		return pb.impl.lsn
+	}
+	//a chain's tail that is not the head answers for what it was sent
+
+	s := pb.impl.streams[pb.impl.view.Backup]
+	if s == nil || !s.synced {
+		*reply = OpReply{Err: ErrWrongServer}
+		return 0
+	}
+	lsn, ok := pb.submit(ReplicateArgs{Kind: entryNop})
+	if !ok {
+		*reply = OpReply{Err: ErrWrongServer}
+		return 0
+	}
+	return lsn
+}
@@ -1,6 +1,7 @@
 package pbservice
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math/rand"
@@ -14,6 +15,8 @@ import (
 	"testing"
 	"time"
 
+	"umich.edu/eecs491/proj2/shardctrl"
+	"umich.edu/eecs491/proj2/transport"
 	"umich.edu/eecs491/proj2/viewservice"
 )
 
@@ -295,12 +298,13 @@ func proxy(t *testing.T, port string, delay *int32) {
 			if err != nil {
 				t.Fatalf("proxy accept failed: %v\n", err)
 			}
-			time.Sleep(time.Duration(atomic.LoadInt32(delay)) * time.Second)
 			c2, err := net.Dial("unix", portx)
 			if err != nil {
 				t.Fatalf("proxy dial failed: %v\n", err)
 			}
 
+			// clients keep their connections (see transport.Pool),
+			// so delay each request on its way in, not the connection
 			go func() {
 				for {
 					buf := make([]byte, 1000)
@@ -314,23 +318,22 @@ func proxy(t *testing.T, port string, delay *int32) {
 					}
 				}
 			}()
-			for {
-				buf := make([]byte, 1000)
-				n, err := c1.Read(buf)
-				if err != nil && err != io.EOF {
-					t.Fatalf("proxy c1.Read: %v\n", err)
-				}
-				if n == 0 {
-					break
-				}
-				n1, err1 := c2.Write(buf[0:n])
-				if err1 != nil || n1 != n {
-					t.Fatalf("proxy c2.Write: %v\n", err1)
+			go func() {
+				for {
+					buf := make([]byte, 1000)
+					n, err := c1.Read(buf)
+					if n == 0 || (err != nil && err != io.EOF) {
+						break
+					}
+					time.Sleep(time.Duration(atomic.LoadInt32(delay)) * time.Second)
+					n1, err1 := c2.Write(buf[0:n])
+					if err1 != nil || n1 != n {
+						break
+					}
 				}
-			}
-
-			c1.Close()
-			c2.Close()
+				c1.Close()
+				c2.Close()
+			}()
 		}
 	}()
 }
@@ -1211,3 +1214,2578 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 	vs.Kill(vsterm)
 	time.Sleep(time.Second)
 }
+
+// kill both primary and backup, restart them from their data
+// directories, and check that nothing was lost.
+func TestPersistRestart(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "persist"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Primary and backup restart from their logs ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	var dirs [nservers]string
+	for i := 0; i < nservers; i++ {
+		dirs[i] = port(tag+"-data", i+1)
+		os.RemoveAll(dirs[i])
+		st[i] = make(chan interface{})
+		sa[i] = StartServerWithOptions(vshost, port(tag, i+1), Options{Dir: dirs[i]}, st[i])
+		time.Sleep(time.Second)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	for i := 0; i < 20; i++ {
+		ck.Put("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	ck.Append("k0", "x")
+	ck.Append("k0", "y")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServerWithOptions(vshost, port(tag, i+1), Options{Dir: dirs[i]}, st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+
+	check(t, ck, "k0", "0xy")
+	for i := 1; i < 20; i++ {
+		check(t, ck, "k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// the Appends above must not be applied a second time
+	ck.Append("k0", "z")
+	check(t, ck, "k0", "0xyz")
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+		os.RemoveAll(dirs[i])
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+func TestDelete(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "delete"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Delete removes keys on primary and backup ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view1, _ := vck.Get()
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "aa")
+	ck.Put("b", "bb")
+
+	if !ck.Delete("a") {
+		t.Fatalf("Delete of an existing key reported it missing")
+	}
+	if ck.Delete("a") {
+		t.Fatalf("second Delete of the same key reported it present")
+	}
+	if ck.Delete("zz") {
+		t.Fatalf("Delete of a key that never existed reported it present")
+	}
+	check(t, ck, "a", "")
+	ck.Append("a", "x")
+	check(t, ck, "a", "x")
+	ck.Delete("a")
+
+	// the backup must have applied the Deletes too
+	for i := 0; i < nservers; i++ {
+		if view1.Primary == sa[i].me {
+			sa[i].kill(st[i])
+			break
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == view1.Backup {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	check(t, ck, "a", "")
+	check(t, ck, "b", "bb")
+	if ck.Delete("a") {
+		t.Fatalf("Delete on new primary found a deleted key")
+	}
+	if !ck.Delete("b") {
+		t.Fatalf("Delete on new primary lost a key")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+// concurrent CompareAndSwap counters over an unreliable network;
+// a retried swap must report the original outcome, or increments
+// get lost or doubled.
+func TestCompareAndSwap(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "cas"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Concurrent CompareAndSwap counters; unreliable ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+		sa[i].setunreliable(true)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view1, _ := vck.Get()
+
+	ck := MakeClerk(vshost, "")
+	if ok, _ := ck.CompareAndSwap("n", "0", "1"); ok {
+		t.Fatalf("CompareAndSwap on a missing key succeeded")
+	}
+	if ok, cur := ck.PutIfAbsent("n", "0"); !ok || cur != "0" {
+		t.Fatalf("PutIfAbsent on a missing key failed")
+	}
+	if ok, cur := ck.PutIfAbsent("n", "5"); ok || cur != "0" {
+		t.Fatalf("PutIfAbsent on an existing key: got %v %v", ok, cur)
+	}
+
+	const nclients = 3
+	const nincr = 20
+	ch := make(chan bool)
+	for i := 0; i < nclients; i++ {
+		go func() {
+			ck := MakeClerk(vshost, "")
+			for j := 0; j < nincr; j++ {
+				cur := ck.Get("n")
+				for {
+					n, _ := strconv.Atoi(cur)
+					ok, now := ck.CompareAndSwap("n", cur, strconv.Itoa(n+1))
+					if ok {
+						break
+					}
+					cur = now
+				}
+			}
+			ch <- true
+		}()
+	}
+	for i := 0; i < nclients; i++ {
+		<-ch
+	}
+	check(t, ck, "n", strconv.Itoa(nclients*nincr))
+
+	// the backup must have made the same decisions
+	for i := 0; i < nservers; i++ {
+		if view1.Primary == sa[i].me {
+			sa[i].kill(st[i])
+			break
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == view1.Backup {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	check(t, ck, "n", strconv.Itoa(nclients*nincr))
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+// concurrent transfers between accounts; the total must never
+// change, on the primary or (after failover) on the backup.
+func TestTransaction(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "txn"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Concurrent transactions; unreliable ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+		sa[i].setunreliable(true)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view1, _ := vck.Get()
+
+	const naccounts = 4
+	const start = 100
+	accounts := []string{}
+	ck := MakeClerk(vshost, "")
+	for i := 0; i < naccounts; i++ {
+		accounts = append(accounts, "acct"+strconv.Itoa(i))
+		ck.Put(accounts[i], strconv.Itoa(start))
+	}
+
+	if _, ok := ck.Transaction(nil, []Cond{{Key: "nokey", Exists: true}},
+		[]Write{{Op: PUT, Key: "nokey", Value: "x"}}); ok {
+		t.Fatalf("Transaction applied despite a failed condition")
+	}
+	check(t, ck, "nokey", "")
+
+	total := func(ck *Clerk) int {
+		vals, _ := ck.Transaction(accounts, nil, nil)
+		sum := 0
+		for _, v := range vals {
+			n, _ := strconv.Atoi(v)
+			sum += n
+		}
+		return sum
+	}
+
+	const nclients = 3
+	ch := make(chan bool)
+	for i := 0; i < nclients; i++ {
+		go func(i int) {
+			ck := MakeClerk(vshost, "")
+			rr := rand.New(rand.NewSource(int64(os.Getpid() + i)))
+			for j := 0; j < 15; j++ {
+				from := accounts[rr.Int()%naccounts]
+				to := accounts[rr.Int()%naccounts]
+				if from == to {
+					continue
+				}
+				for {
+					vals, _ := ck.Transaction([]string{from, to}, nil, nil)
+					a, _ := strconv.Atoi(vals[0])
+					b, _ := strconv.Atoi(vals[1])
+					_, ok := ck.Transaction(nil,
+						[]Cond{{Key: from, Exists: true, Value: vals[0]},
+							{Key: to, Exists: true, Value: vals[1]}},
+						[]Write{{Op: PUT, Key: from, Value: strconv.Itoa(a - 1)},
+							{Op: PUT, Key: to, Value: strconv.Itoa(b + 1)}})
+					if ok {
+						break
+					}
+				}
+			}
+			ch <- true
+		}(i)
+	}
+	for i := 0; i < nclients; i++ {
+		<-ch
+	}
+	if n := total(ck); n != naccounts*start {
+		t.Fatalf("total on primary is %v, wanted %v", n, naccounts*start)
+	}
+	vals, _ := ck.Transaction(accounts, nil, nil)
+
+	for i := 0; i < nservers; i++ {
+		if view1.Primary == sa[i].me {
+			sa[i].kill(st[i])
+			break
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == view1.Backup {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	for i := 0; i < naccounts; i++ {
+		check(t, ck, accounts[i], vals[i])
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+// the ordered store against a plain map.
+func TestStore(t *testing.T) {
+	fmt.Printf("Test: Ordered store ...\n")
+
+	st := newStore()
+	m := map[string]string{}
+	rr := rand.New(rand.NewSource(int64(os.Getpid())))
+	for i := 0; i < 5000; i++ {
+		k := strconv.Itoa(rr.Int() % 1000)
+		switch rr.Int() % 3 {
+		case 0, 1:
+			st.put(k, strconv.Itoa(i))
+			m[k] = strconv.Itoa(i)
+		case 2:
+			st.del(k)
+			delete(m, k)
+		}
+	}
+	if st.size() != len(m) {
+		t.Fatalf("store has %v keys, wanted %v", st.size(), len(m))
+	}
+	for k, v := range m {
+		if v1, ok := st.get(k); !ok || v1 != v {
+			t.Fatalf("store get(%v) -> %v, wanted %v", k, v1, v)
+		}
+	}
+
+	pairs := st.scan("", "", len(m)+1)
+	if len(pairs) != len(m) {
+		t.Fatalf("full scan returned %v pairs, wanted %v", len(pairs), len(m))
+	}
+	for i := 1; i < len(pairs); i++ {
+		if pairs[i-1].Key >= pairs[i].Key {
+			t.Fatalf("scan out of order: %v then %v", pairs[i-1].Key, pairs[i].Key)
+		}
+	}
+	for _, kv := range st.scan("3", "4", 1000) {
+		if !strings.HasPrefix(kv.Key, "3") || m[kv.Key] != kv.Value {
+			t.Fatalf("scan [3,4) returned %v=%v", kv.Key, kv.Value)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestStoreVersions(t *testing.T) {
+	fmt.Printf("Test: Store keeps earlier versions ...\n")
+
+	st := newStore()
+	st.retain(3, time.Minute)
+	st.put("a", "1")
+	st.put("b", "x")
+	st.put("a", "2")
+	st.del("b")
+	st.put("a", "3")
+	st.put("a", "4")
+	if v, rev, ok := st.lookup("a"); !ok || v != "4" || rev != 6 || st.rev != 6 {
+		t.Fatalf("lookup(a) -> %v at %v, store at %v", v, rev, st.rev)
+	}
+	cases := []struct {
+		key   string
+		rev   int64
+		value string
+		ok    bool
+		err   Err
+	}{
+		{"a", 6, "4", true, OK},
+		{"a", 5, "3", true, OK},
+		{"a", 4, "2", true, OK},
+		{"a", 3, "2", true, OK},
+		{"a", 2, "1", true, OK},
+		{"b", 2, "x", true, OK},
+		{"b", 4, "", false, OK},
+		{"b", 6, "", false, OK},
+		{"c", 6, "", false, OK},
+		{"a", 7, "", false, ErrNoRev},
+	}
+	for _, c := range cases {
+		v, _, ok, err := st.at(c.key, c.rev)
+		if v != c.value || ok != c.ok || err != c.err {
+			t.Fatalf("at(%v, %v) -> %v %v %v, wanted %v %v %v", c.key, c.rev,
+				v, ok, err, c.value, c.ok, c.err)
+		}
+	}
+
+	st.put("a", "5")
+	if _, _, _, err := st.at("a", 2); err != ErrCompacted {
+		t.Fatalf("at(a, 2) past the 3 kept -> %v", err)
+	}
+	st.put("b", "y")
+	if v, rev, ok, _ := st.at("b", 3); !ok || v != "x" || rev != 2 {
+		t.Fatalf("at(b, 3) after b came back -> %v at %v", v, rev)
+	}
+	st2 := storeFrom(st.toMap(), st.revs(), st.versions())
+	st2.setRev(st.rev, st.forgot)
+	if v, _, ok, err := st2.at("a", 4); !ok || v != "2" || err != OK {
+		t.Fatalf("copy at(a, 4) -> %v %v %v", v, ok, err)
+	}
+
+	st.keep = 0
+	st.del("a")
+	if _, _, _, err := st.at("a", 4); err != ErrCompacted {
+		t.Fatalf("at(a, 4) with no versions kept -> %v", err)
+	}
+	if _, _, ok, err := st.at("z", 4); ok || err != ErrCompacted {
+		t.Fatalf("at(z, 4) before a forgotten delete -> %v %v", ok, err)
+	}
+
+	st = newStore()
+	st.retain(10, time.Millisecond)
+	st.put("a", "1")
+	st.put("a", "2")
+	st.del("a")
+	time.Sleep(10 * time.Millisecond)
+	st.sweep()
+	if _, _, _, err := st.at("a", 1); err != ErrCompacted || len(st.gone) != 0 || st.forgot != 3 {
+		t.Fatalf("at(a, 1) after its delete aged out -> %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestScan(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "scan"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Scan and ListPrefix ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view1, _ := vck.Get()
+
+	ck := MakeClerk(vshost, "")
+	const nkeys = 25
+	for i := 0; i < nkeys; i++ {
+		ck.Put(fmt.Sprintf("dir/%03d", i), strconv.Itoa(i))
+	}
+	ck.Put("dip", "x")
+	ck.Put("dir0", "x")
+	ck.Delete("dir/007")
+
+	// page through the directory, 4 at a time
+	got := []KeyValue{}
+	start := "dir/"
+	for {
+		pairs, next := ck.Scan(start, "dir0", 4)
+		if len(pairs) > 4 {
+			t.Fatalf("Scan returned %v pairs, limit was 4", len(pairs))
+		}
+		got = append(got, pairs...)
+		if next == "" {
+			break
+		}
+		start = next
+	}
+	if len(got) != nkeys-1 {
+		t.Fatalf("Scan found %v keys, wanted %v", len(got), nkeys-1)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1].Key >= got[i].Key {
+			t.Fatalf("Scan out of order: %v then %v", got[i-1].Key, got[i].Key)
+		}
+	}
+	if got[0].Key != "dir/000" || got[0].Value != "0" {
+		t.Fatalf("Scan started at %v=%v", got[0].Key, got[0].Value)
+	}
+
+	// the backup keeps the same ordered store
+	for i := 0; i < nservers; i++ {
+		if view1.Primary == sa[i].me {
+			sa[i].kill(st[i])
+			break
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == view1.Backup {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	keys := ck.ListPrefix("dir/")
+	if len(keys) != nkeys-1 {
+		t.Fatalf("ListPrefix found %v keys, wanted %v", len(keys), nkeys-1)
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "dir/") || k == "dir/007" {
+			t.Fatalf("ListPrefix returned %v", k)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+func TestTTL(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "ttl"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view1, _ := vck.Get()
+
+	ck := MakeClerk(vshost, "")
+
+	fmt.Printf("Test: Keys expire after their TTL ...\n")
+
+	ck.PutWithTTL("short", "s", 500*time.Millisecond)
+	ck.PutWithTTL("long", "l", 4*time.Second)
+	ck.PutWithTTL("kept", "k1", 500*time.Millisecond)
+	ck.Put("kept", "k2")
+	ck.PutWithTTL("appended", "a", 500*time.Millisecond)
+	ck.Append("appended", "b")
+	ck.Put("plain", "p")
+
+	check(t, ck, "short", "s")
+	check(t, ck, "appended", "ab")
+	time.Sleep(time.Second)
+
+	check(t, ck, "short", "")
+	check(t, ck, "appended", "")
+	check(t, ck, "kept", "k2")
+	check(t, ck, "long", "l")
+	check(t, ck, "plain", "p")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Transactions do not see expired keys ...\n")
+
+	for i := 0; i < 20; i++ {
+		ck.PutWithTTL("lock", "held", time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
+		vals, ok := ck.Transaction([]string{"lock"}, []Cond{{Key: "lock", Exists: false}},
+			[]Write{{Op: PUT, Key: "taken", Value: strconv.Itoa(i)}})
+		if !ok || vals[0] != "" {
+			t.Fatalf("transaction saw an expired key: %v %v", vals, ok)
+		}
+	}
+	check(t, ck, "taken", "19")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: TTLs survive failover ...\n")
+
+	for i := 0; i < nservers; i++ {
+		if view1.Primary == sa[i].me {
+			sa[i].kill(st[i])
+			break
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == view1.Backup {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	check(t, ck, "short", "")
+	check(t, ck, "long", "l")
+	time.Sleep(4 * time.Second)
+	check(t, ck, "long", "")
+	check(t, ck, "kept", "k2")
+	check(t, ck, "plain", "p")
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestTransfer(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "transfer"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Transfer a large database in pages while serving ...\n")
+
+	s1term := make(chan interface{})
+	s1 := StartServer(vshost, port(tag, 1), s1term)
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s1.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	ck := MakeClerk(vshost, "")
+	const nkeys = pushPage*2 + pushPage/2
+	for i := 0; i < nkeys; i++ {
+		ck.Put("k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	ck.PutWithTTL("ttl", "x", 300*time.Millisecond)
+
+	s2term := make(chan interface{})
+	s2 := StartServer(vshost, port(tag, 2), s2term)
+
+	// keep writing while the backup catches up
+	for i := 0; i < 100; i++ {
+		ck.Append("k0", "+"+strconv.Itoa(i))
+		ck.Put("new"+strconv.Itoa(i), "n"+strconv.Itoa(i))
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*4; iters++ {
+		view, _ := vck.Get()
+		if view.Backup == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view, _ := vck.Get()
+	if view.Primary != s1.me || view.Backup != s2.me {
+		t.Fatalf("backup never joined; view %v", view)
+	}
+
+	s1.kill(s1term)
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	want := "v0"
+	for i := 0; i < 100; i++ {
+		want += "+" + strconv.Itoa(i)
+	}
+	check(t, ck, "k0", want)
+	for i := 1; i < nkeys; i += 97 {
+		check(t, ck, "k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	for i := 0; i < 100; i++ {
+		check(t, ck, "new"+strconv.Itoa(i), "n"+strconv.Itoa(i))
+	}
+	check(t, ck, "ttl", "")
+	if keys := ck.ListPrefix("k"); len(keys) != nkeys {
+		t.Fatalf("wrong number of keys after transfer; got %v, wanted %v", len(keys), nkeys)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill(s2term)
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestDedupTable(t *testing.T) {
+	fmt.Printf("Test: Duplicate table keeps one result per client ...\n")
+
+	pb := new(PBServer)
+	pb.impl.results = make(map[string]clientResult)
+
+	for seq := 1; seq <= 100; seq++ {
+		pb.ackResults("c1", seq-1)
+		pb.recordResult("c1", seq, OpReply{Err: OK, Value: strconv.Itoa(seq)})
+	}
+	pb.recordResult("c2", 7, OpReply{Err: ErrNoKey})
+	if len(pb.impl.results) != 2 {
+		t.Fatalf("table has %v entries, wanted 2", len(pb.impl.results))
+	}
+
+	if r, _, ok := pb.cachedResult("c1", 100); !ok || r.Value != "100" {
+		t.Fatalf("lost the latest result: %v %v", ok, r)
+	}
+	if _, _, ok := pb.cachedResult("c1", 101); ok {
+		t.Fatalf("found a result for an op not yet applied")
+	}
+	if _, _, ok := pb.cachedResult("c1", 3); !ok || !pb.applied("c1", 3) {
+		t.Fatalf("old duplicate not recognized")
+	}
+
+	pb.ackResults("c1", 100)
+	if r, _, _ := pb.cachedResult("c1", 100); r.Value != "" {
+		t.Fatalf("result kept after the client acked it")
+	}
+	if !pb.applied("c1", 100) {
+		t.Fatalf("forgot the SeqNo along with the result")
+	}
+
+	cr := pb.impl.results["c2"]
+	cr.Seen = time.Now().Add(-2 * clientIdle)
+	pb.impl.results["c2"] = cr
+	pb.sweepClients()
+	if _, ok := pb.impl.results["c2"]; ok {
+		t.Fatalf("idle client not forgotten")
+	}
+	if _, ok := pb.impl.results["c1"]; !ok {
+		t.Fatalf("active client forgotten")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDedupWindow(t *testing.T) {
+	fmt.Printf("Test: Duplicate table with ops finishing out of order ...\n")
+
+	pb := new(PBServer)
+	pb.impl.results = make(map[string]clientResult)
+
+	// 1..10 outstanding, the even ones get here first
+	for seq := 2; seq <= 10; seq += 2 {
+		pb.ackResults("c1", 0)
+		pb.recordResult("c1", seq, OpReply{Err: OK, Value: strconv.Itoa(seq)})
+	}
+	if pb.applied("c1", 3) {
+		t.Fatalf("an op not yet applied taken for a duplicate")
+	}
+	if _, _, ok := pb.cachedResult("c1", 5); ok {
+		t.Fatalf("found a result for an op not yet applied")
+	}
+	for seq := 1; seq <= 9; seq += 2 {
+		if pb.applied("c1", seq) {
+			t.Fatalf("op %v taken for a duplicate", seq)
+		}
+		pb.recordResult("c1", seq, OpReply{Err: OK, Value: strconv.Itoa(seq)})
+	}
+	for seq := 1; seq <= 10; seq++ {
+		if r, _, ok := pb.cachedResult("c1", seq); !ok || r.Value != strconv.Itoa(seq) {
+			t.Fatalf("lost the result of op %v: %v %v", seq, ok, r)
+		}
+	}
+
+	pb.ackResults("c1", 6)
+	if n := len(pb.impl.results["c1"].Replies); n != 4 {
+		t.Fatalf("kept %v results after the ack, wanted 4", n)
+	}
+	if r, _, ok := pb.cachedResult("c1", 4); !ok || r.Value != "" || !pb.applied("c1", 4) {
+		t.Fatalf("acked op not recognized as a duplicate")
+	}
+	if r, _, _ := pb.cachedResult("c1", 7); r.Value != "7" {
+		t.Fatalf("lost an unacked result")
+	}
+
+	// another server takes the table over
+	pb2 := new(PBServer)
+	pb2.impl.results = make(map[string]clientResult)
+	pb2.mergeResults(pb2.impl.results, makeResult("c1", pb.impl.results["c1"]))
+	if !pb2.applied("c1", 5) || !pb2.applied("c1", 10) || pb2.applied("c1", 11) {
+		t.Fatalf("table not carried over")
+	}
+	if r, _, _ := pb2.cachedResult("c1", 9); r.Value != "9" {
+		t.Fatalf("result not carried over")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMultipleBackups(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "backups"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServerWithOptions(vshost, viewservice.Options{Backups: 2}, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Survive the primary and a backup failing in turn ...\n")
+
+	const nservers = 3
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if len(view.Backups) == 2 {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view1, _ := vck.Get()
+	if len(view1.Backups) != 2 {
+		t.Fatalf("wanted two backups, got view %v", view1)
+	}
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "1")
+	ck.Append("a", "2")
+	ck.Put("b", "x")
+
+	kill := func(name string) {
+		for i := 0; i < nservers; i++ {
+			if sa[i].me == name {
+				sa[i].kill(st[i])
+			}
+		}
+	}
+	waitPrimary := func(name string) {
+		for iters := 0; iters < viewservice.DeadPings*4; iters++ {
+			view, _ := vck.Get()
+			if view.Primary == name {
+				return
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		view, _ := vck.Get()
+		t.Fatalf("wanted primary %v, got view %v", name, view)
+	}
+
+	kill(view1.Primary)
+	waitPrimary(view1.Backups[0])
+	check(t, ck, "a", "12")
+	ck.Append("a", "3")
+
+	// the new primary acks once the remaining backup has its state
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	kill(view1.Backups[0])
+	waitPrimary(view1.Backups[1])
+	check(t, ck, "a", "123")
+	check(t, ck, "b", "x")
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestChain(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "chain"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServerWithOptions(vshost,
+		viewservice.Options{Backups: 2, Chain: true}, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Chain replication, reads from the tail ...\n")
+
+	const nservers = 3
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if len(view.Backups) == 2 {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view1, _ := vck.Get()
+	if !view1.Chain || len(view1.Backups) != 2 {
+		t.Fatalf("wanted a chain of three, got view %v", view1)
+	}
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "1")
+	check(t, ck, "a", "1")
+	for i := 2; i <= 20; i++ {
+		ck.Append("a", strconv.Itoa(i))
+	}
+	want := ""
+	for i := 1; i <= 20; i++ {
+		want += strconv.Itoa(i)
+	}
+	check(t, ck, "a", want)
+
+	// a read at the head is turned away while there is a tail
+	args := OpArgs{Op: GET, Key: "a", Client: "direct", SeqNo: 1, Source: "direct"}
+	var reply OpReply
+	call(view1.Primary, "PBServer.Operation", args, &reply)
+	if reply.Err != ErrWrongServer {
+		t.Fatalf("head answered a read: %v", reply)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	kill := func(name string) {
+		for i := 0; i < nservers; i++ {
+			if sa[i].me == name {
+				sa[i].kill(st[i])
+			}
+		}
+	}
+
+	fmt.Printf("Test: Chain relinks when the middle fails ...\n")
+
+	kill(view1.Backups[0])
+	for iters := 0; iters < viewservice.DeadPings*4; iters++ {
+		view, _ := vck.Get()
+		if len(view.Backups) == 1 {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	ck.Append("a", "x")
+	want += "x"
+	check(t, ck, "a", want)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Chain survives the head failing ...\n")
+
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	kill(view1.Primary)
+	for iters := 0; iters < viewservice.DeadPings*4; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == view1.Backups[1] {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	check(t, ck, "a", want)
+	ck.Put("b", "y")
+	check(t, ck, "b", "y")
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestPipelined(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "pipelined"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Concurrent clients, then the primary fails ...\n")
+
+	s1term := make(chan interface{})
+	s1 := StartServer(vshost, port(tag, 1), s1term)
+	time.Sleep(viewservice.PingInterval * 2)
+	s2term := make(chan interface{})
+	s2 := StartServer(vshost, port(tag, 2), s2term)
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s1.me && view.Backup == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	const nclients = 20
+	const nops = 50
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ck := MakeClerk(vshost, "")
+			for j := 0; j < nops; j++ {
+				ck.Append("k"+strconv.Itoa(i), strconv.Itoa(j)+".")
+			}
+		}(i)
+	}
+	wg.Wait()
+	fmt.Printf("  %d appends in %v\n", nclients*nops, time.Since(start))
+
+	s1.kill(s1term)
+	for iters := 0; iters < viewservice.DeadPings*4; iters++ {
+		if vck.Primary() == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if vck.Primary() != s2.me {
+		t.Fatalf("backup never took over")
+	}
+
+	want := ""
+	for j := 0; j < nops; j++ {
+		want += strconv.Itoa(j) + "."
+	}
+	ck := MakeClerk(vshost, "")
+	for i := 0; i < nclients; i++ {
+		check(t, ck, "k"+strconv.Itoa(i), want)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill(s2term)
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestStaleRead(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "stale"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Backup answers stale Gets ...\n")
+
+	s1term := make(chan interface{})
+	s1 := StartServer(vshost, port(tag, 1), s1term)
+	time.Sleep(viewservice.PingInterval * 2)
+	s2term := make(chan interface{})
+	s2 := StartServer(vshost, port(tag, 2), s2term)
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s1.me && view.Backup == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	view, _ := vck.Get()
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "1")
+	ck.Put("b", "2")
+	if ck.LastLSN() == 0 {
+		t.Fatalf("writes did not report their log entry")
+	}
+
+	// straight to the backup, which turns away ordinary Gets
+	args := OpArgs{Op: GET, Key: "a", MaxStale: time.Second, MinLSN: ck.LastLSN(),
+		Client: "direct", Source: "direct"}
+	var reply OpReply
+	if !call(s2.me, "PBServer.Operation", args, &reply) || reply.Err != OK ||
+		reply.Value != "1" {
+		t.Fatalf("backup did not answer a stale Get: %v", reply)
+	}
+	if reply.Viewnum != view.Viewnum || reply.LSN < ck.LastLSN() {
+		t.Fatalf("backup answered from view %v entry %v, wanted %v and at least %v",
+			reply.Viewnum, reply.LSN, view.Viewnum, ck.LastLSN())
+	}
+
+	args.MinLSN = reply.LSN + 1000
+	reply = OpReply{}
+	call(s2.me, "PBServer.Operation", args, &reply)
+	if reply.Err != ErrStale {
+		t.Fatalf("backup answered without the entry asked for: %v", reply)
+	}
+
+	value, _, lsn := ck.GetStaleAfter("b", time.Second, ck.LastLSN())
+	if value != "2" || lsn < ck.LastLSN() {
+		t.Fatalf("GetStaleAfter -> %v at %v", value, lsn)
+	}
+	if v := ck.GetStale("c", time.Second); v != "" {
+		t.Fatalf("GetStale of a missing key -> %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Stale Gets fall back to the primary ...\n")
+
+	// a staleness bound below the heartbeat interval is too tight for the backup
+	ck.Put("a", "3")
+	if v := ck.GetStale("a", time.Nanosecond); v != "3" {
+		t.Fatalf("GetStale -> %v, wanted 3", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Stale Gets to a backup that became primary ...\n")
+
+	// ck still has s2 down as a backup
+	s1.kill(s1term)
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ = vck.Get()
+		if view.Primary == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if view.Primary != s2.me {
+		t.Fatalf("backup was not promoted: %v", view)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	for i := 0; i < 10; i++ {
+		if v := ck.GetStale("b", time.Second); v != "2" {
+			t.Fatalf("GetStale from the new primary -> %v, wanted 2", v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill(s2term)
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestShards(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "shards"
+	ctrlhost := port(tag+"c", 1)
+	ctrlterm := make(chan interface{})
+	ctrl := shardctrl.StartServer(ctrlhost, ctrlterm)
+	ctrlck := shardctrl.MakeClerk(ctrlhost)
+
+	// two replica groups, each a viewservice with a primary and a backup
+	const ngroups = 2
+	var vsterms [ngroups]chan interface{}
+	var vss [ngroups]*viewservice.ViewServer
+	var vshosts [ngroups]string
+	var terms [ngroups][2]chan interface{}
+	var servers [ngroups][2]*PBServer
+	for g := 0; g < ngroups; g++ {
+		gtag := tag + strconv.Itoa(g+1)
+		vshosts[g] = port(gtag+"v", 1)
+		vsterms[g] = make(chan interface{})
+		vss[g] = viewservice.StartServer(vshosts[g], vsterms[g])
+		for i := 0; i < 2; i++ {
+			terms[g][i] = make(chan interface{})
+			opts := Options{Ctrl: ctrlhost, GID: int64(g + 1)}
+			servers[g][i] = StartServerWithOptions(vshosts[g], port(gtag, i+1), opts, terms[g][i])
+		}
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	fmt.Printf("Test: Sharded Puts and Gets ...\n")
+
+	ctrlck.Join(1, vshosts[0])
+	ck := MakeShardClerk(ctrlhost)
+	const nkeys = 30
+	for i := 0; i < nkeys; i++ {
+		ck.Put("k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	for i := 0; i < nkeys; i++ {
+		if v := ck.Get("k" + strconv.Itoa(i)); v != "v"+strconv.Itoa(i) {
+			t.Fatalf("Get(k%v) -> %v", i, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Shards move to a group that joins ...\n")
+
+	ctrlck.Join(2, vshosts[1])
+	for i := 0; i < nkeys; i++ {
+		ck.Append("k"+strconv.Itoa(i), "x")
+	}
+	for i := 0; i < nkeys; i++ {
+		if v := ck.Get("k" + strconv.Itoa(i)); v != "v"+strconv.Itoa(i)+"x" {
+			t.Fatalf("Get(k%v) -> %v after the Join", i, v)
+		}
+	}
+
+	// group 1 turns away keys it handed to group 2
+	config := ctrlck.Query(-1)
+	vck := viewservice.MakeClerk("", vshosts[0])
+	view, _ := vck.Get()
+	checked := false
+	for i := 0; i < nkeys && !checked; i++ {
+		key := "k" + strconv.Itoa(i)
+		if config.Shards[shardctrl.Key2Shard(key)] != 2 {
+			continue
+		}
+		args := OpArgs{Op: GET, Key: key, Client: "direct", Source: "direct"}
+		var reply OpReply
+		for iters := 0; iters < 50; iters++ {
+			reply = OpReply{}
+			call(view.Primary, "PBServer.Operation", args, &reply)
+			if reply.Err == ErrWrongGroup {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		//group 1 may not have moved on to the new config yet
+		if reply.Err != ErrWrongGroup {
+			t.Fatalf("group 1 still answers for %v, which moved: %v", key, reply)
+		}
+		checked = true
+	}
+	if !checked {
+		t.Fatalf("no key moved to the group that joined")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Shards move off a group that leaves ...\n")
+
+	ctrlck.Leave(1)
+	for i := 0; i < nkeys; i += 2 {
+		if !ck.Delete("k" + strconv.Itoa(i)) {
+			t.Fatalf("Delete(k%v) found no key", i)
+		}
+	}
+	//the shards are all with group 2 once these go through
+
+	vck2 := viewservice.MakeClerk("", vshosts[1])
+	for i := 0; i < nkeys; i++ {
+		args := OpArgs{Op: GET, Key: "k" + strconv.Itoa(i), Client: "direct", Source: "direct"}
+		var reply OpReply
+		for iters := 0; iters < 50; iters++ {
+			view, _ := vck2.Get()
+			reply = OpReply{}
+			call(view.Primary, "PBServer.Operation", args, &reply)
+			if reply.Err == OK || reply.Err == ErrNoKey {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		if reply.Err != OK && reply.Err != ErrNoKey {
+			t.Fatalf("group 2 does not serve k%v after the Leave: %v", i, reply)
+		}
+	}
+	//group 1 hands over the shards the Deletes did not touch in its own time
+
+	for i := 0; i < 2; i++ {
+		servers[0][i].kill(terms[0][i])
+	}
+	for i := 0; i < nkeys; i++ {
+		want := "v" + strconv.Itoa(i) + "x"
+		if i%2 == 0 {
+			want = ""
+		}
+		if v := ck.Get("k" + strconv.Itoa(i)); v != want {
+			t.Fatalf("Get(k%v) -> %v after the Leave, wanted %v", i, v, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < 2; i++ {
+		servers[1][i].kill(terms[1][i])
+	}
+	time.Sleep(time.Second)
+	for g := 0; g < ngroups; g++ {
+		vss[g].Kill(vsterms[g])
+	}
+	ctrl.Kill(ctrlterm)
+}
+
+// a free "host:port" on the loopback interface
+func tcpPort(t *testing.T) string {
+	l, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen on tcp: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestTCP(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := tcpPort(t)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Primary and backup over tcp ...\n")
+
+	s1term := make(chan interface{})
+	s1 := StartServer(vshost, tcpPort(t), s1term)
+	time.Sleep(viewservice.PingInterval * 2)
+	s2term := make(chan interface{})
+	s2 := StartServer(vshost, tcpPort(t), s2term)
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s1.me && view.Backup == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view, _ := vck.Get()
+	if view.Primary != s1.me || view.Backup != s2.me {
+		t.Fatalf("no primary and backup over tcp: %v", view)
+	}
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "1")
+	ck.Append("a", "2")
+	check(t, ck, "a", "12")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Unreliable tcp connections ...\n")
+
+	s1.setunreliable(true)
+	s2.setunreliable(true)
+	for i := 0; i < 20; i++ {
+		ck.Append("b", strconv.Itoa(i))
+	}
+	want := ""
+	for i := 0; i < 20; i++ {
+		want += strconv.Itoa(i)
+	}
+	check(t, ck, "b", want)
+	s1.setunreliable(false)
+	s2.setunreliable(false)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Failover over tcp ...\n")
+
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	s1.kill(s1term)
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ = vck.Get()
+		if view.Primary == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if view.Primary != s2.me {
+		t.Fatalf("backup not promoted over tcp: %v", view)
+	}
+	check(t, ck, "a", "12")
+	check(t, ck, "b", want)
+
+	fmt.Printf("  ... Passed\n")
+
+	s2.kill(s2term)
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestTLS(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "tls"
+	ca, err := transport.MakeCA()
+	if err != nil {
+		t.Fatalf("MakeCA: %v", err)
+	}
+	issue := func(name string) *transport.Creds {
+		creds, err := ca.Issue(name)
+		if err != nil {
+			t.Fatalf("Issue(%v): %v", name, err)
+		}
+		return creds
+	}
+
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServerWithOptions(vshost, viewservice.Options{Creds: issue(vshost)}, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerkWithCreds("watcher", vshost, issue("watcher"))
+
+	fmt.Printf("Test: Primary and backup over TLS ...\n")
+
+	s1term := make(chan interface{})
+	s1 := StartServerWithOptions(vshost, port(tag, 1), Options{Creds: issue(port(tag, 1))}, s1term)
+	time.Sleep(viewservice.PingInterval * 2)
+	s2term := make(chan interface{})
+	s2 := StartServerWithOptions(vshost, port(tag, 2), Options{Creds: issue(port(tag, 2))}, s2term)
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s1.me && view.Backup == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view, _ := vck.Get()
+	if view.Primary != s1.me || view.Backup != s2.me {
+		t.Fatalf("no primary and backup over TLS: %v", view)
+	}
+
+	ck := MakeClerkWithCreds(vshost, "", issue("clerk"))
+	ck.Put("a", "1")
+	ck.Append("a", "2")
+	check(t, ck, "a", "12")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Callers cannot pose as servers ...\n")
+
+	// a clerk's certificate does not make it the primary to the backup
+	mallory := issue("mallory")
+	rargs := ReplicateArgs{Source: s1.me, LSN: 1000, Kind: entryOp,
+		Op: OpArgs{Op: PUT, Key: "a", Value: "evil", Client: "m", SeqNo: 1}}
+	var rreply ReplicateReply
+	if callCreds(mallory, s2.me, "PBServer.Replicate", &rargs, &rreply) && rreply.Err == OK {
+		t.Fatalf("backup took an entry from an impostor")
+	}
+
+	// nor a copy of the whole database
+	pargs := PushArgs{View: view, Source: s1.me, Version: 1, Last: true,
+		KVStore: []KeyValue{{Key: "a", Value: "evil"}}}
+	var preply PushReply
+	if callCreds(mallory, s2.me, "PBServer.Push", &pargs, &preply) && preply.Err == OK {
+		t.Fatalf("backup took a Push from an impostor")
+	}
+
+	// nor does naming a server in a Ping draft it
+	vsmallory := viewservice.MakeClerkWithCreds(port(tag, 3), vshost, mallory)
+	for i := 0; i < viewservice.DeadPings*2; i++ {
+		vsmallory.Ping(0)
+		time.Sleep(viewservice.PingInterval)
+	}
+	view, _ = vck.Get()
+	for _, server := range append([]string{view.Primary}, view.Backups...) {
+		if server == port(tag, 3) {
+			t.Fatalf("view has %v, which never pinged: %v", server, view)
+		}
+	}
+
+	// and without a certificate there is no talking to a server at all
+	var reply OpReply
+	if call(s1.me, "PBServer.Operation", &OpArgs{Op: GET, Key: "a"}, &reply) {
+		t.Fatalf("server answered without TLS")
+	}
+	check(t, ck, "a", "12")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Callers cannot pose as a group handing over a shard ...\n")
+
+	// group 1 has no servers, so group 2 waits for its shards forever
+	ctrlhost := port(tag+"c", 1)
+	ctrlterm := make(chan interface{})
+	ctrl := shardctrl.StartServer(ctrlhost, ctrlterm)
+	ctrlck := shardctrl.MakeClerk(ctrlhost)
+	ctrlck.Join(1, port(tag+"v", 2))
+
+	gvshost := port(tag+"v", 3)
+	gvsterm := make(chan interface{})
+	gvs := viewservice.StartServerWithOptions(gvshost, viewservice.Options{Creds: issue(gvshost)}, gvsterm)
+	time.Sleep(time.Second)
+	s3term := make(chan interface{})
+	s3 := StartServerWithOptions(gvshost, port(tag, 3),
+		Options{Creds: issue(port(tag, 3)), Ctrl: ctrlhost, GID: 2}, s3term)
+	ctrlck.Join(2, gvshost)
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings * 2)
+
+	config := ctrlck.Query(2)
+	key := ""
+	for i := 0; key == ""; i++ {
+		k := "k" + strconv.Itoa(i)
+		if config.Shards[shardctrl.Key2Shard(k)] == 2 {
+			key = k
+		}
+	}
+	sargs := ShardArgs{Num: 2, Shard: shardctrl.Key2Shard(key), Source: port(tag, 1),
+		KVStore: []KeyValue{{Key: key, Value: "evil"}}}
+	var sreply ShardReply
+	if callCreds(mallory, s3.me, "PBServer.Shard", &sargs, &sreply) && sreply.Err == OK {
+		t.Fatalf("group took a shard from an impostor")
+	}
+	gargs := OpArgs{Op: GET, Key: key, Client: "direct", Source: "direct"}
+	var greply OpReply
+	callCreds(issue("clerk"), s3.me, "PBServer.Operation", &gargs, &greply)
+	if greply.Err != ErrWrongGroup {
+		t.Fatalf("group serves a shard it never got: %v", greply)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s3.kill(s3term)
+	gvs.Kill(gvsterm)
+	ctrl.Kill(ctrlterm)
+	s1.kill(s1term)
+	s2.kill(s2term)
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestPooledBreaks(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "pooled"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	s1term := make(chan interface{})
+	s1 := StartServer(vshost, port(tag, 1), s1term)
+	time.Sleep(viewservice.PingInterval * 2)
+	s2term := make(chan interface{})
+	s2 := StartServer(vshost, port(tag, 2), s2term)
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary == s1.me && view.Backup == s2.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	fmt.Printf("Test: At-most-once when pooled connections break mid-call ...\n")
+
+	// keep closing everyone's connections to both servers, whatever is on them
+	pool := transport.Shared(nil)
+	done := int32(0)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&done) == 0 {
+			for _, server := range []string{s1.me, s2.me} {
+				if c, err := pool.Get(server); err == nil {
+					pool.Discard(server, c)
+				}
+			}
+			time.Sleep(time.Duration(rand.Int63()%20) * time.Millisecond)
+		}
+	}()
+	s1.setunreliable(true)
+	s2.setunreliable(true)
+
+	const nclients = 4
+	const nappends = 25
+	var clients sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			ck := MakeClerk(vshost, "")
+			for j := 0; j < nappends; j++ {
+				ck.Append("k"+strconv.Itoa(i), "x"+strconv.Itoa(j)+"y")
+			}
+		}(i)
+	}
+	appended := make(chan bool)
+	go func() {
+		clients.Wait()
+		appended <- true
+	}()
+	select {
+	case <-appended:
+	case <-time.After(60 * time.Second):
+		t.Fatalf("appends did not finish")
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+	s1.setunreliable(false)
+	s2.setunreliable(false)
+
+	ck := MakeClerk(vshost, "")
+	for i := 0; i < nclients; i++ {
+		want := ""
+		for j := 0; j < nappends; j++ {
+			want += "x" + strconv.Itoa(j) + "y"
+		}
+		check(t, ck, "k"+strconv.Itoa(i), want)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill(s1term)
+	s2.kill(s2term)
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestClerkContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "ctx"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	// how long a call that gives up at timeout may take
+	const timeout = 500 * time.Millisecond
+	bounded := func(what string, start time.Time, timeout time.Duration) {
+		if d := time.Since(start); d > timeout+2*viewservice.PingInterval {
+			t.Fatalf("%v took %v with a %v deadline", what, d, timeout)
+		}
+	}
+	// deadlines that fall at different points of the Clerk's retries
+	deadlines := []time.Duration{50 * time.Millisecond, 150 * time.Millisecond,
+		220 * time.Millisecond, 350 * time.Millisecond, timeout}
+
+	fmt.Printf("Test: Deadline with no primary ...\n")
+
+	ck := MakeClerk(vshost, "")
+	for _, d := range deadlines {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		start := time.Now()
+		_, err := ck.GetCtx(ctx, "a")
+		cancel()
+		if err != ErrNoPrimary {
+			t.Fatalf("GetCtx with no primary and a %v deadline -> %v, wanted ErrNoPrimary", d, err)
+		}
+		bounded("GetCtx", start, d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Operations within a deadline ...\n")
+
+	s1term := make(chan interface{})
+	s1 := StartServer(vshost, port(tag, 1), s1term)
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		if vck.Primary() == s1.me {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := ck.PutCtx(ctx, "a", "1"); err != nil {
+		t.Fatalf("PutCtx -> %v", err)
+	}
+	if err := ck.AppendCtx(ctx, "a", "2"); err != nil {
+		t.Fatalf("AppendCtx -> %v", err)
+	}
+	if v, err := ck.GetCtx(ctx, "a"); err != nil || v != "12" {
+		t.Fatalf("GetCtx -> %v, %v; wanted 12", v, err)
+	}
+	if v, err := ck.GetCtx(ctx, "b"); err != nil || v != "" {
+		t.Fatalf("GetCtx of a missing key -> %v, %v", v, err)
+	}
+	cancel()
+	check(t, ck, "a", "12")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Deadline with a dead primary ...\n")
+
+	// no backup to take over, so the view keeps naming s1
+	s1.kill(s1term)
+	for _, d := range deadlines {
+		ctx, cancel = context.WithTimeout(context.Background(), d)
+		start := time.Now()
+		err := ck.PutCtx(ctx, "a", "3")
+		cancel()
+		if err != ErrTimeout {
+			t.Fatalf("PutCtx to a dead primary with a %v deadline -> %v, wanted ErrTimeout", d, err)
+		}
+		bounded("PutCtx", start, d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Cancellation ...\n")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(timeout)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := ck.GetCtx(ctx, "a")
+	if err != context.Canceled {
+		t.Fatalf("cancelled GetCtx -> %v, wanted context.Canceled", err)
+	}
+	bounded("cancelled GetCtx", start, timeout)
+
+	fmt.Printf("  ... Passed\n")
+
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestConcurrentClerk(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "cclerk"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Many operations in flight from one Clerk; unreliable ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+		sa[i].setunreliable(true)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	// give p+b time to ack, initialize
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	ctx := context.Background()
+
+	// futures, more of them than fit in the window at once
+	const nasync = 3 * clerkWindow
+	futures := make([]*Future, nasync)
+	for i := 0; i < nasync; i++ {
+		futures[i] = ck.AppendAsync(ctx, "k", "<"+strconv.Itoa(i)+">")
+	}
+
+	// and other goroutines using the same Clerk meanwhile
+	const nclients = 5
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			key := "c" + strconv.Itoa(c)
+			for i := 0; i < 10; i++ {
+				ck.Append(key, strconv.Itoa(i))
+			}
+		}(c)
+	}
+
+	for i, f := range futures {
+		if _, err := f.Wait(); err != nil {
+			t.Fatalf("AppendAsync %v -> %v", i, err)
+		}
+	}
+	wg.Wait()
+
+	v := ck.Get("k")
+	for i := 0; i < nasync; i++ {
+		if n := strings.Count(v, "<"+strconv.Itoa(i)+">"); n != 1 {
+			t.Fatalf("Append %v applied %v times", i, n)
+		}
+	}
+	for c := 0; c < nclients; c++ {
+		check(t, ck, "c"+strconv.Itoa(c), "0123456789")
+	}
+
+	f := ck.GetAsync(ctx, "c0")
+	<-f.Done()
+	if v, err := f.Wait(); err != nil || v != "0123456789" {
+		t.Fatalf("GetAsync -> %v, %v", v, err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+func TestBatching(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "batch"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Batched writes keep their order ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	var dirs [nservers]string
+	for i := 0; i < nservers; i++ {
+		dirs[i] = port(tag+"-data", i+1)
+		os.RemoveAll(dirs[i])
+		st[i] = make(chan interface{})
+		sa[i] = StartServerWithOptions(vshost, port(tag, i+1), Options{Dir: dirs[i]}, st[i])
+		time.Sleep(time.Second)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	ck.SetBatching(10*time.Millisecond, 0)
+	ctx := context.Background()
+
+	// appends one after another, each in the order it was started
+	appends := func(key string, n int) string {
+		futures := make([]*Future, n)
+		want := ""
+		for i := 0; i < n; i++ {
+			v := "<" + strconv.Itoa(i) + ">"
+			futures[i] = ck.AppendAsync(ctx, key, v)
+			want += v
+		}
+		for i, f := range futures {
+			if _, err := f.Wait(); err != nil {
+				t.Fatalf("AppendAsync %v -> %v", i, err)
+			}
+		}
+		return want
+	}
+
+	const nappends = 2 * clerkWindow
+	want := appends("k", nappends)
+	check(t, ck, "k", want)
+	if lsn := ck.LastLSN(); lsn <= 0 || lsn >= nappends {
+		t.Fatalf("%v appends took %v log entries", nappends, lsn)
+	}
+
+	// each op in a batch sees the ones before it
+	var wg sync.WaitGroup
+	for c := 0; c < 5; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			key := "c" + strconv.Itoa(c)
+			ck.Put(key, "a")
+			if ok, v := ck.PutIfAbsent(key, "b"); ok || v != "a" {
+				t.Errorf("PutIfAbsent -> %v %v", ok, v)
+			}
+			if ok, v := ck.CompareAndSwap(key, "a", "c"); !ok || v != "c" {
+				t.Errorf("CompareAndSwap -> %v %v", ok, v)
+			}
+			ck.Append(key, "d")
+			if !ck.Delete(key) || ck.Delete(key) {
+				t.Errorf("Delete of a key that existed once")
+			}
+			ck.Append(key, "e")
+		}(c)
+	}
+	wg.Wait()
+	for c := 0; c < 5; c++ {
+		check(t, ck, "c"+strconv.Itoa(c), "e")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Batched writes; unreliable ...\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].setunreliable(true)
+	}
+	wantu := appends("u", nappends)
+	for i := 0; i < nservers; i++ {
+		sa[i].setunreliable(false)
+	}
+	check(t, ck, "u", wantu)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Batched writes survive a restart ...\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServerWithOptions(vshost, port(tag, i+1), Options{Dir: dirs[i]}, st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+
+	check(t, ck, "k", want)
+	check(t, ck, "u", wantu)
+	check(t, ck, "c0", "e")
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+		os.RemoveAll(dirs[i])
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+func TestWatchHistory(t *testing.T) {
+	fmt.Printf("Test: Watch history ...\n")
+
+	pb := new(PBServer)
+	pb.impl.kv = newStore()
+	pb.resetChanges(0)
+	for lsn := int64(1); pb.impl.history == 0; lsn++ {
+		pb.impl.lsn = lsn
+		v := strconv.FormatInt(lsn, 10)
+		pb.applyWrite(PUT, "a", v, time.Time{})
+		pb.applyWrite(APPEND, "b", "x", time.Time{})
+	}
+	pb.impl.commit = pb.impl.lsn
+	rev := pb.impl.kv.rev
+	if len(pb.impl.changes) > maxChanges || pb.impl.changes[0].Rev != pb.impl.history+1 {
+		t.Fatalf("trimmed to %v changes from %v, after %v", len(pb.impl.changes),
+			pb.impl.changes[0].Rev, pb.impl.history)
+	}
+	if last := pb.impl.changes[len(pb.impl.changes)-1]; last.Rev != rev || last.LSN != pb.impl.lsn {
+		t.Fatalf("last change at revision %v, entry %v", last.Rev, last.LSN)
+	}
+
+	var reply WatchReply
+	args := WatchArgs{Key: "a", After: pb.impl.history - 1}
+	if !pb.watchReady(&args, &reply) || reply.Err != ErrCompacted {
+		t.Fatalf("watch from a trimmed revision -> %v", reply.Err)
+	}
+	args = WatchArgs{Key: "a", After: pb.impl.history}
+	if !pb.watchReady(&args, &reply) || reply.Err != OK || len(reply.Events) != maxWatch {
+		t.Fatalf("watch -> %v with %v events", reply.Err, len(reply.Events))
+	}
+	if reply.Events[0].Rev <= pb.impl.history || reply.Rev != reply.Events[maxWatch-1].Rev {
+		t.Fatalf("watch went from %v through %v", reply.Events[0].Rev, reply.Rev)
+	}
+	args = WatchArgs{Key: "", Prefix: true, After: rev - 2}
+	if !pb.watchReady(&args, &reply) || len(reply.Events) != 2 || reply.Rev != rev {
+		t.Fatalf("prefix watch -> %v events through %v", len(reply.Events), reply.Rev)
+	}
+	args = WatchArgs{Key: "a", After: rev}
+	if pb.watchReady(&args, &reply) || reply.Rev != rev {
+		t.Fatalf("watch with nothing new -> %v events through %v", len(reply.Events), reply.Rev)
+	}
+
+	pb.impl.commit = pb.impl.lsn - 1
+	if r := pb.committedRev(); r != rev-2 {
+		t.Fatalf("revision as of the last commit is %v, wanted %v", r, rev-2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWatch(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "watch"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Watch a prefix ...\n")
+
+	const nservers = 3
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("cfg/a", "0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := ck.WatchPrefix(ctx, "cfg/", 0)
+	wa := ck.Watch(ctx, "cfg/a", 0)
+	time.Sleep(viewservice.PingInterval)
+	//let the watches get to the primary, they start from then
+
+	next := func(w *Watcher) Event {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				t.Fatalf("watch ended: %v", w.Err())
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event")
+		}
+		return Event{}
+	}
+	expect := func(w *Watcher, op Op, key string, value string, after int64) Event {
+		ev := next(w)
+		if ev.Op != op || ev.Key != key || ev.Value != value || ev.Rev <= after || ev.Viewnum == 0 {
+			t.Fatalf("got %v, wanted %v %v %v after revision %v", ev, op, key, value, after)
+		}
+		return ev
+	}
+
+	ck.Put("cfg/a", "1")
+	ck.Put("other", "x")
+	ck.Append("cfg/a", "2")
+	ck.Put("cfg/b", "3")
+	ck.Delete("cfg/a")
+	ck.Delete("cfg/a")
+
+	ev1 := expect(w, PUT, "cfg/a", "1", 0)
+	ev2 := expect(w, APPEND, "cfg/a", "2", ev1.Rev)
+	ev3 := expect(w, PUT, "cfg/b", "3", ev2.Rev)
+	ev4 := expect(w, DELETE, "cfg/a", "", ev3.Rev)
+
+	ev := expect(wa, PUT, "cfg/a", "1", 0)
+	ev = expect(wa, APPEND, "cfg/a", "2", ev.Rev)
+	expect(wa, DELETE, "cfg/a", "", ev.Rev)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch from a revision ...\n")
+
+	w2 := ck.WatchPrefix(ctx, "cfg/", ev2.Rev)
+	expect(w2, PUT, "cfg/b", "3", ev2.Rev)
+	expect(w2, DELETE, "cfg/a", "", ev3.Rev)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch across a change of primary ...\n")
+
+	view, _ := vck.Get()
+	ck2 := MakeClerk(vshost, "")
+	const nwrites = 30
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < nwrites; i++ {
+			ck2.Append("cfg/c", strconv.Itoa(i)+" ")
+			time.Sleep(20 * time.Millisecond)
+		}
+		done <- true
+	}()
+	time.Sleep(200 * time.Millisecond)
+	killed := -1
+	for i := 0; i < nservers; i++ {
+		if sa[i].me == view.Primary {
+			sa[i].kill(st[i])
+			killed = i
+		}
+	}
+
+	last := ev4.Rev
+	for i := 0; i < nwrites; i++ {
+		ev := expect(w, APPEND, "cfg/c", strconv.Itoa(i)+" ", last)
+		last = ev.Rev
+	}
+	<-done
+	if view2, _ := vck.Get(); view2.Primary == view.Primary {
+		t.Fatalf("primary did not change")
+	}
+
+	cancel()
+	for range w.Events {
+	}
+	if w.Err() != context.Canceled {
+		t.Fatalf("cancelled watch ended with %v", w.Err())
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if i != killed {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+func TestVersions(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "versions"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Get as of an earlier revision ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	var dirs [nservers]string
+	opts := func(i int) Options {
+		return Options{Dir: dirs[i], KeepVersions: 3, KeepFor: time.Minute}
+	}
+	for i := 0; i < nservers; i++ {
+		dirs[i] = port(tag+"-data", i+1)
+		os.RemoveAll(dirs[i])
+		st[i] = make(chan interface{})
+		sa[i] = StartServerWithOptions(vshost, port(tag, i+1), opts(i), st[i])
+		time.Sleep(time.Second)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	var revs []int64
+	for i := 0; i < 5; i++ {
+		ck.Put("a", strconv.Itoa(i))
+		ck.Put("other", strconv.Itoa(i))
+		_, rev := ck.GetRev("a")
+		if len(revs) > 0 && rev <= revs[len(revs)-1] {
+			t.Fatalf("revision went from %v to %v", revs[len(revs)-1], rev)
+		}
+		revs = append(revs, rev)
+	}
+	ck.Delete("a")
+	if v, rev := ck.GetRev("a"); v != "" || rev != 0 {
+		t.Fatalf("GetRev of a deleted key -> %v at %v", v, rev)
+	}
+	ck.Put("other", "x")
+	_, now := ck.GetRev("other")
+
+	checkAt := func(key string, rev int64, value string, exists bool) {
+		v, ok, _, err := ck.GetAt(key, rev)
+		if err != nil || v != value || ok != exists {
+			t.Fatalf("GetAt(%v, %v) -> %v %v %v, wanted %v %v", key, rev, v, ok, err, value, exists)
+		}
+	}
+	for i := 2; i < 5; i++ {
+		checkAt("a", revs[i], strconv.Itoa(i), true)
+		checkAt("a", revs[i]+1, strconv.Itoa(i), true)
+	}
+	checkAt("a", now, "", false)
+	if _, _, _, err := ck.GetAt("a", revs[0]); err != ErrRevCompacted {
+		t.Fatalf("GetAt past what is kept -> %v", err)
+	}
+	if _, _, _, err := ck.GetAt("a", now+100); err != ErrRevAhead {
+		t.Fatalf("GetAt a future revision -> %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Transaction conditional on a revision ...\n")
+
+	ck.Put("b", "x")
+	_, rev := ck.GetRev("b")
+	if _, ok := ck.Transaction(nil, []Cond{{Key: "b", Exists: true, Rev: rev - 1}},
+		[]Write{{Op: PUT, Key: "b", Value: "y"}}); ok {
+		t.Fatalf("transaction applied with a stale revision")
+	}
+	if _, ok := ck.Transaction(nil, []Cond{{Key: "b", Exists: true, Rev: rev}},
+		[]Write{{Op: PUT, Key: "b", Value: "y"}}); !ok {
+		t.Fatalf("transaction failed with the current revision")
+	}
+	check(t, ck, "b", "y")
+	checkAt("b", rev, "x", true)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Versions survive a restart and a failover ...\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServerWithOptions(vshost, port(tag, i+1), opts(i), st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+
+	checkAt("a", revs[3], "3", true)
+	checkAt("b", rev, "x", true)
+
+	view, _ := vck.Get()
+	killed := -1
+	for i := 0; i < nservers; i++ {
+		if sa[i].me == view.Primary {
+			sa[i].kill(st[i])
+			killed = i
+		}
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+
+	checkAt("a", revs[4], "4", true)
+	checkAt("b", rev, "x", true)
+	if _, rev2 := ck.GetRev("b"); rev2 <= rev {
+		t.Fatalf("revision of b went from %v to %v", rev, rev2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if i != killed {
+			sa[i].kill(st[i])
+		}
+		os.RemoveAll(dirs[i])
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+func TestBackup(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	// start a viewservice and nservers servers under tag, and wait for a view with a backup
+	const nservers = 2
+	start := func(tag string, opts func(i int) Options) (*viewservice.ViewServer, chan interface{},
+		[nservers]chan interface{}, [nservers]*PBServer) {
+		vshost := port(tag+"v", 1)
+		vsterm := make(chan interface{})
+		vs := viewservice.StartServer(vshost, vsterm)
+		time.Sleep(time.Second)
+		vck := viewservice.MakeClerk("", vshost)
+
+		var st [nservers]chan interface{}
+		var sa [nservers]*PBServer
+		for i := 0; i < nservers; i++ {
+			st[i] = make(chan interface{})
+			sa[i] = StartServerWithOptions(vshost, port(tag, i+1), opts(i), st[i])
+		}
+		for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+			view, _ := vck.Get()
+			if view.Primary != "" && view.Backup != "" {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+		return vs, vsterm, st, sa
+	}
+
+	fmt.Printf("Test: Backup the primary to a file ...\n")
+
+	file := port("backup-file", 1)
+	os.Remove(file)
+	keep := func(i int) Options { return Options{KeepVersions: 2} }
+	vs, vsterm, st, sa := start("backup", keep)
+	ck := MakeClerk(port("backupv", 1), "")
+	for i := 0; i < 20; i++ {
+		ck.Put("k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	ck.Append("k0", "x")
+	ck.mu.Lock()
+	appended := ck.seqno
+	ck.mu.Unlock()
+	ck.Delete("k19")
+	_, rev := ck.GetRev("k0")
+
+	b, err := ck.Backup(file)
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if len(b.KVStore) != 19 || b.LSN == 0 || b.Viewnum == 0 || b.Rev < rev {
+		t.Fatalf("backup has %v keys as of view %v, LSN %v, revision %v",
+			len(b.KVStore), b.Viewnum, b.LSN, b.Rev)
+	}
+	ck.Put("late", "x")
+	b2, err := ReadBackup(file)
+	if err != nil || len(b2.KVStore) != 19 || b2.LSN != b.LSN || len(b2.OpCache) != 1 {
+		t.Fatalf("ReadBackup -> %v keys as of LSN %v, %v", len(b2.KVStore), b2.LSN, err)
+	}
+
+	data, _ := os.ReadFile(file)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(file+"-bad", data, 0666)
+	if _, err := ReadBackup(file + "-bad"); err == nil {
+		t.Fatalf("ReadBackup of a corrupt file worked")
+	}
+	data, _ = os.ReadFile(file)
+	data[len(backupMagic)]++
+	os.WriteFile(file+"-bad", data, 0666)
+	if _, err := ReadBackup(file + "-bad"); err == nil {
+		t.Fatalf("ReadBackup of a newer format version worked")
+	}
+	os.Remove(file + "-bad")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	vs.Kill(vsterm)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Restore a fresh cluster from a backup ...\n")
+
+	var dirs [nservers]string
+	for i := 0; i < nservers; i++ {
+		dirs[i] = port("restore-data", i+1)
+		os.RemoveAll(dirs[i])
+	}
+	persist := func(i int) Options { return Options{Dir: dirs[i], KeepVersions: 2} }
+	vs, vsterm, st, sa = start("restore", persist)
+	vshost := port("restorev", 1)
+	ck2 := MakeClerk(vshost, "")
+	if err := ck2.Restore(file); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	check(t, ck2, "k0", "0x")
+	check(t, ck2, "k19", "")
+	check(t, ck2, "late", "")
+	for i := 1; i < 19; i++ {
+		check(t, ck2, "k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	if _, rev2 := ck2.GetRev("k0"); rev2 != rev {
+		t.Fatalf("restored k0 at revision %v, was %v", rev2, rev)
+	}
+	if v, ok, _, err := ck2.GetAt("k0", rev-1); err != nil || !ok || v != "0" {
+		t.Fatalf("restored k0 as of revision %v -> %v %v %v", rev-1, v, ok, err)
+	}
+	if err := ck2.Restore(file); err != ErrClusterNotEmpty {
+		t.Fatalf("Restore into a cluster with data -> %v", err)
+	}
+
+	// the old cluster's client resends its Append, which the backup has
+	args := OpArgs{Op: APPEND, Key: "k0", Value: "x", Client: ck.me, SeqNo: appended, Source: ck.me}
+	var reply OpReply
+	ck2.issue("PBServer.Operation", args, &reply, false)
+	check(t, ck2, "k0", "0x")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Restored data survives a failover and a restart ...\n")
+
+	vck := viewservice.MakeClerk("", vshost)
+	view, _ := vck.Get()
+	for i := 0; i < nservers; i++ {
+		if sa[i].me == view.Primary {
+			sa[i].kill(st[i])
+			st[i] = make(chan interface{})
+			sa[i] = StartServerWithOptions(vshost, port("restore", i+1), persist(i), st[i])
+		}
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+	check(t, ck2, "k0", "0x")
+	check(t, ck2, "k5", "5")
+	ck2.Put("k5", "new")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServerWithOptions(vshost, port("restore", i+1), persist(i), st[i])
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+	check(t, ck2, "k0", "0x")
+	check(t, ck2, "k5", "new")
+	check(t, ck2, "k18", "18")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Backup gives up once its context is done ...\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+		os.RemoveAll(dirs[i])
+	}
+	const timeout = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	start0 := time.Now()
+	_, err = ck2.BackupCtx(ctx, file+"-dead")
+	cancel()
+	if err != ErrTimeout {
+		t.Fatalf("BackupCtx with every server dead -> %v, wanted ErrTimeout", err)
+	}
+	if d := time.Since(start0); d > timeout+2*viewservice.PingInterval {
+		t.Fatalf("BackupCtx took %v with a %v deadline", d, timeout)
+	}
+	vs.Kill(vsterm)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Restore a backup of many pages ...\n")
+
+	big := Backup{Expires: make(map[string]time.Time)}
+	nkeys := 2*pushPage + pushPage/2
+	for i := 0; i < nkeys; i++ {
+		big.KVStore = append(big.KVStore, KeyValue{Key: fmt.Sprintf("b%05d", i), Value: strconv.Itoa(i), Rev: int64(i + 1)})
+	}
+	big.Rev = int64(nkeys)
+	if err := WriteBackup(file, big); err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	vs, vsterm, st, sa = start("restore-big", keep)
+	vshost = port("restore-bigv", 1)
+	ck3 := MakeClerk(vshost, "")
+	if err := ck3.Restore(file); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	check(t, ck3, "b00000", "0")
+	check(t, ck3, fmt.Sprintf("b%05d", nkeys-1), strconv.Itoa(nkeys-1))
+
+	// the backup got it in pages too, and can take over with all of it
+	vck = viewservice.MakeClerk("", vshost)
+	view, _ = vck.Get()
+	killed := -1
+	for i := 0; i < nservers; i++ {
+		if sa[i].me == view.Primary {
+			sa[i].kill(st[i])
+			killed = i
+		}
+	}
+	time.Sleep(2 * viewservice.PingInterval * viewservice.DeadPings)
+	for i := 0; i < nkeys; i += pushPage / 3 {
+		check(t, ck3, fmt.Sprintf("b%05d", i), strconv.Itoa(i))
+	}
+	check(t, ck3, fmt.Sprintf("b%05d", nkeys-1), strconv.Itoa(nkeys-1))
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if i != killed {
+			sa[i].kill(st[i])
+		}
+	}
+	os.Remove(file)
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
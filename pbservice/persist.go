@@ -0,0 +1,249 @@
+package pbservice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"umich.edu/eecs491/proj2/shardctrl"
+)
+
+//
+// On-disk state for a PBServer started with a data directory.
+//
+// The directory holds two files:
+//
+//   snapshot  a gob-encoded copy of the whole database, replaced
+//             atomically (write to a temp file, then rename)
+//   wal       every mutation applied since the snapshot was taken
+//
+// Each wal record is framed as
+//
+//   [4 byte length][4 byte crc32 of payload][payload]
+//
+// where the payload is a gob-encoded walEntry. On startup the
+// snapshot is loaded and the wal replayed on top of it. A torn or
+// corrupt record ends the replay and the wal is truncated there,
+// since it can only be the tail of a write that never finished.
+//
+
+const (
+	snapshotFile = "snapshot"
+	walFile      = "wal"
+
+	// rewrite the snapshot (and empty the wal) after this many records
+	compactEvery = 1000
+)
+
+// Kinds of wal records
+const (
+	entryOp       = iota // an applied mutation
+	entryView            // the server moved to a new view
+	entryTxn             // an applied transaction
+	entryNop             // never logged, only sent to the backups (see lease.go)
+	entryConfig          // moved on to the next shard config (see shard.go)
+	entryShardIn         // got the data of a shard from its old owner
+	entryShardOut        // handed a shard over to its new owner
+	entryBatch           // several mutations applied as a unit (see batch.go)
+)
+
+type walEntry struct {
+	Kind      int
+	Args      OpArgs               // entryOp: the mutation
+	Txn       TxnArgs              // entryTxn: the transaction
+	Reply     OpReply              // entryOp, entryTxn: the result handed back to the client
+	Deadline  time.Time            // entryOp: when a PutWithTTL expires
+	Viewnum   uint                 // entryView: the new view #
+	Config    shardctrl.Config     // entryConfig: the new config
+	Shard     ShardArgs            // entryShardIn, entryShardOut: the shard
+	Expires   map[string]time.Time // entryShardIn: when its keys expire
+	Batch     []OpArgs             // entryBatch: the mutations
+	Replies   []OpReply            // entryBatch: their results
+	Deadlines []time.Time          // entryBatch: when each expires, like Deadline
+}
+
+type snapshot struct {
+	KV       map[string]string
+	Revs     map[string]int64     // the revision of each key in KV
+	Versions map[string][]version // earlier values of keys (see store.go)
+	Rev      int64                // the store's revision
+	Forgot   int64                // and the one before which it may have dropped deletes
+	Results map[string]clientResult
+	Expires map[string]time.Time
+	Viewnum uint
+	Config  shardctrl.Config
+	Shards  [shardctrl.NShards]int
+}
+
+var errCorrupt = errors.New("corrupt wal record")
+
+type persister struct {
+	dir     string
+	wal     *os.File
+	entries int // records in the wal since the last snapshot
+}
+
+// open (or create) the data directory. a nil persister is returned
+// for an empty dir, and all its methods are no-ops.
+func openPersister(dir string) (*persister, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	ps := &persister{dir: dir}
+	return ps, nil
+}
+
+//
+// read back the snapshot and every intact wal record after it.
+// leaves the wal open for appending, positioned after the last
+// good record.
+//
+func (ps *persister) load() (snapshot, []walEntry, error) {
+	snap := snapshot{}
+	if ps == nil {
+		return snap, nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(ps.dir, snapshotFile))
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&snap)
+		if err != nil {
+			return snap, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return snap, nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(ps.dir, walFile), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return snap, nil, err
+	}
+
+	var entries []walEntry
+	var good int64
+	for {
+		e, n, err := readEntry(f)
+		if err != nil {
+			break
+		}
+		entries = append(entries, e)
+		good += n
+	}
+	// drop whatever partial record follows the last good one
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return snap, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return snap, nil, err
+	}
+
+	ps.wal = f
+	ps.entries = len(entries)
+	return snap, entries, nil
+}
+
+// returns the next record and the number of bytes it took up
+func readEntry(r io.Reader) (walEntry, int64, error) {
+	var e walEntry
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return e, 0, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:4])
+	sum := binary.LittleEndian.Uint32(hdr[4:8])
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return e, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return e, 0, errCorrupt
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&e); err != nil {
+		return e, 0, errCorrupt
+	}
+	return e, int64(len(hdr)) + int64(size), nil
+}
+
+//
+// append a record to the wal and wait for it to reach the disk.
+//
+func (ps *persister) appendEntry(e walEntry) error {
+	if ps == nil {
+		return nil
+	}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(e); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8+payload.Len())
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(buf[8:], payload.Bytes())
+
+	if _, err := ps.wal.Write(buf); err != nil {
+		return err
+	}
+	if err := ps.wal.Sync(); err != nil {
+		return err
+	}
+	ps.entries++
+	return nil
+}
+
+//
+// replace the snapshot with snap, then empty the wal. a crash
+// between the two steps only means some records are replayed on
+// top of a snapshot that already contains them, so the records
+// must be safe to apply twice (results[] makes them so).
+//
+func (ps *persister) saveSnapshot(snap snapshot) error {
+	if ps == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snap); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(ps.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, filepath.Join(ps.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if err := ps.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := ps.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	ps.entries = 0
+	return nil
+}
@@ -0,0 +1,421 @@
+package pbservice
+
+import (
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"umich.edu/eecs491/proj2/transport"
+	"umich.edu/eecs491/proj2/viewservice"
+)
+
+//
+// Pipelined replication.
+//
+// Every mutation the primary applies gets the next log sequence
+// number (LSN). The primary applies it right away, so that the next
+// one is decided against it, and hands it to a stream for each
+// backup (in a chain, each server streams to its successor). A
+// stream is a goroutine with a pooled connection to its backup,
+// which keeps up to maxInFlight entries on the wire at once, in LSN
+// order.
+//
+// The backup applies entries strictly in LSN order, holding on to
+// those that arrive early, and replies to each one once it has
+// applied it (in a chain, once its own successor has too). So a
+// reply for an LSN acks every entry before it as well.
+//
+// A client gets its reply once its entry is committed, i.e. acked by
+// every backup that counts (see advance). A read waits until all
+// that was applied before it has committed, so nobody sees a write
+// that could still be lost. If the connection breaks, the stream
+// dials again and resends whatever is not acked yet; the backup
+// answers entries it already has straight away. If the backup will
+// not take our entries at all, we start over with a fresh snapshot
+// (see transfer.go).
+//
+
+const maxInFlight = 64
+
+// our link to a server downstream of us
+type stream struct {
+	backup string
+	snap   *transfer // our state as of snap.lsn, sent before any entries
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	backlog []ReplicateArgs // entries after the snapshot not acked yet, in LSN order
+	closed  bool
+
+	// owned by run_channels
+	synced  bool  // the backup has the snapshot
+	acked   int64 // the backup has applied the entries up through this one
+	probing bool  // a probe of the backup is out (see chain.go)
+}
+
+// an entry's client (or in a chain, predecessor) waiting for it to commit
+type waiter struct {
+	lsn  int64
+	done chan bool
+	fail func() // if it may never commit, called before done
+}
+
+type replReq struct {
+	args  ReplicateArgs
+	reply *ReplicateReply
+	done  chan bool
+}
+
+// what a stream tells run_channels
+const (
+	streamSynced   = iota // the snapshot is in
+	streamAcked           // entries up through lsn are applied
+	streamRejected        // the backup would not take an entry, or no longer has our state
+	streamProbed          // the backup still has our state (see chain.go)
+)
+
+type streamMsg struct {
+	s     *stream
+	event int
+	lsn   int64
+	done  chan bool
+}
+
+// freeze our state and start streaming it to backup
+func (pb *PBServer) startStream(backup string) {
+	s := &stream{backup: backup, snap: pb.freeze(backup)}
+	s.cond = sync.NewCond(&s.mu)
+	pb.impl.streams[backup] = s
+	go pb.runStream(s)
+}
+
+// stop s, its goroutine exits as soon as it notices
+func (s *stream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *stream) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// queue an entry for the backup
+func (s *stream) push(args ReplicateArgs) {
+	s.mu.Lock()
+	s.backlog = append(s.backlog, args)
+	s.cond.Signal()
+	s.mu.Unlock()
+}
+
+// the first queued entry after lsn; if block, wait for one. false once closed
+func (s *stream) next(lsn int64, block bool) (ReplicateArgs, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed {
+		i := sort.Search(len(s.backlog), func(i int) bool { return s.backlog[i].LSN > lsn })
+		if i < len(s.backlog) {
+			return s.backlog[i], true
+		}
+		if !block {
+			break
+		}
+		s.cond.Wait()
+	}
+	return ReplicateArgs{}, false
+}
+
+// forget the entries the backup has acked
+func (s *stream) trim(acked int64) {
+	s.mu.Lock()
+	i := sort.Search(len(s.backlog), func(i int) bool { return s.backlog[i].LSN > acked })
+	s.backlog = s.backlog[i:]
+	s.mu.Unlock()
+}
+
+// runs in its own goroutine: send the snapshot, then the entries after it
+func (pb *PBServer) runStream(s *stream) {
+	if !pb.sendState(s) {
+		return
+	}
+	pb.streamEvent(s, streamSynced, s.snap.lsn)
+
+	acked := s.snap.lsn
+	pool := transport.Shared(pb.creds)
+	for !pb.isdead() && !s.isClosed() {
+		conn, err := pool.Get(s.backup)
+		if err != nil {
+			time.Sleep(viewservice.PingInterval)
+			continue
+		}
+		var rejected bool
+		acked, rejected = pb.pipe(s, conn, acked)
+		if rejected {
+			pb.streamEvent(s, streamRejected, acked)
+			return
+		}
+		if !pb.isdead() && !s.isClosed() {
+			pool.Discard(s.backup, conn)
+		}
+		//the connection broke, resend everything not acked on a new one
+	}
+}
+
+//
+// keep entries flowing to the backup over conn until the stream is
+// closed or the connection breaks. returns the last entry acked, and
+// whether the backup turned one down.
+//
+func (pb *PBServer) pipe(s *stream, conn *rpc.Client, acked int64) (int64, bool) {
+	replies := make(chan *rpc.Call, maxInFlight)
+	sent := acked
+	inflight := 0
+	for !pb.isdead() {
+		for inflight < maxInFlight {
+			args, ok := s.next(sent, inflight == 0)
+			if !ok {
+				break
+			}
+			conn.Go("PBServer.Replicate", &args, &ReplicateReply{}, replies)
+			sent = args.LSN
+			inflight++
+		}
+		if inflight == 0 {
+			return acked, false
+		}
+		//nothing on the wire and nothing to send: closed
+
+		call := <-replies
+		inflight--
+		if call.Error != nil {
+			return acked, false
+		}
+		if call.Reply.(*ReplicateReply).Err != OK {
+			return acked, true
+		}
+		lsn := call.Args.(*ReplicateArgs).LSN
+		if lsn > acked {
+			acked = lsn
+			s.trim(acked)
+			pb.streamEvent(s, streamAcked, acked)
+		}
+	}
+	return acked, false
+}
+
+// tell run_channels how s is doing (see streamImpl)
+func (pb *PBServer) streamEvent(s *stream, event int, lsn int64) {
+	msg := &streamMsg{
+		s:     s,
+		event: event,
+		lsn:   lsn,
+		done:  make(chan bool),
+	}
+	pb.impl.stream_chan <- msg
+	<-msg.done
+}
+
+// runs in run_channels
+func (pb *PBServer) streamImpl(msg *streamMsg) {
+	s := msg.s
+	if pb.impl.streams[s.backup] != s {
+		return
+	}
+	//a stream we have since replaced
+
+	switch msg.event {
+	case streamSynced:
+		s.synced = true
+		s.acked = msg.lsn
+	case streamAcked:
+		s.acked = msg.lsn
+	case streamProbed:
+		s.probing = false
+	case streamRejected:
+		s.close()
+		pb.startStream(s.backup)
+		return
+	}
+	pb.advance()
+}
+
+//
+// log and apply an entry, then queue it for every server downstream
+// of us. false if the log could not be written, in which case the
+// entry is not applied either.
+//
+func (pb *PBServer) apply(args ReplicateArgs) bool {
+	prev := pb.impl.lsn
+	pb.impl.lsn = args.LSN
+	pb.impl.logview = args.Viewnum
+	//recordResult and recordChange tag what they keep with the entry
+
+	ok := false
+	switch args.Kind {
+	case entryOp:
+		ok = pb.commitOp(&args.Op, args.Result)
+	case entryTxn:
+		ok = pb.commitTxn(&args.Txn, args.Result)
+	case entryBatch:
+		ok = pb.commitBatch(args.Batch, args.Results)
+	case entryNop:
+		ok = true
+	case entryConfig, entryShardIn, entryShardOut:
+		ok = pb.commitShard(walEntry{Kind: args.Kind, Config: args.Config, Shard: args.Shard})
+	}
+	if !ok {
+		pb.impl.lsn = prev
+		return false
+	}
+
+	pb.impl.stamp = args.Stamp
+	args.Source = pb.me
+	for _, s := range pb.impl.streams {
+		s.push(args)
+	}
+	pb.advance()
+	return true
+}
+
+// as primary, apply a mutation we decided under the next LSN
+func (pb *PBServer) submit(args ReplicateArgs) (int64, bool) {
+	args.LSN = pb.impl.lsn + 1
+	args.Stamp = time.Now()
+	args.Viewnum = pb.impl.view.Viewnum
+	return args.LSN, pb.apply(args)
+}
+
+//
+// move the commit point up to the last entry every server downstream
+// of us has applied. a backup that is still being filled does not
+// count until it is synced, but only while the view is unacked: once
+// the viewservice may promote it, it must have whatever we answer
+// for, and in a chain the tail must have it to be read.
+//
+func (pb *PBServer) advance() {
+	commit := pb.impl.lsn
+	for _, backup := range pb.downstream() {
+		s := pb.impl.streams[backup]
+		if s == nil || !s.synced {
+			if pb.impl.view.Chain || pb.impl.acked >= pb.impl.view.Viewnum {
+				return
+			}
+			continue
+		}
+		if s.acked < commit {
+			commit = s.acked
+		}
+	}
+	if commit <= pb.impl.commit {
+		return
+	}
+	pb.impl.commit = commit
+
+	kept := pb.impl.waiting[:0]
+	for _, w := range pb.impl.waiting {
+		if w.lsn <= commit {
+			w.done <- true
+		} else {
+			kept = append(kept, w)
+		}
+	}
+	pb.impl.waiting = kept
+	pb.checkWatchers()
+}
+
+// have done signalled once lsn commits (at once if it has)
+func (pb *PBServer) waitCommit(lsn int64, done chan bool, fail func()) {
+	if lsn <= pb.impl.commit {
+		done <- true
+		return
+	}
+	pb.impl.waiting = append(pb.impl.waiting, waiter{lsn: lsn, done: done, fail: fail})
+}
+
+//
+// give up on everything waiting for a commit or an earlier entry, when
+// we are no longer in the place in the view they counted on.
+//
+func (pb *PBServer) abandon() {
+	for _, w := range pb.impl.waiting {
+		w.fail()
+		w.done <- true
+	}
+	pb.impl.waiting = nil
+	for lsn, reqs := range pb.impl.held {
+		for _, req := range reqs {
+			req.reply.Err = ErrWrongServer
+			req.done <- true
+		}
+		delete(pb.impl.held, lsn)
+	}
+}
+
+// Replicate() sends the req through the channel, like Operation()
+func (pb *PBServer) Replicate(args ReplicateArgs, reply *ReplicateReply) error {
+	req := &replReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+	}
+	pb.impl.repl_chan <- req
+	<-req.done
+	return nil
+}
+
+// what replicate() does (runs in run_channels goroutine)
+func (pb *PBServer) replicateImpl(req *replReq) {
+	args := &req.args
+	if !pb.admitUpstream(args.Source) {
+		req.reply.Err = ErrWrongServer
+		req.done <- true
+		return
+	}
+
+	if args.LSN > pb.impl.lsn+1 {
+		pb.impl.held[args.LSN] = append(pb.impl.held[args.LSN], req)
+		return
+	}
+	//too early, wait for the entries before it
+
+	pb.applyUpstream(req)
+	for {
+		reqs, ok := pb.impl.held[pb.impl.lsn+1]
+		if !ok {
+			return
+		}
+		delete(pb.impl.held, pb.impl.lsn+1)
+		for _, req := range reqs {
+			pb.applyUpstream(req)
+		}
+	}
+}
+
+// apply an entry from upstream that is next (or already applied) and reply once it commits
+func (pb *PBServer) applyUpstream(req *replReq) {
+	if req.args.LSN > pb.impl.lsn && !pb.apply(req.args) {
+		req.reply.Err = ErrWrongServer
+		req.done <- true
+		return
+	}
+	//the same entry twice is a resend, it only needs an answer
+
+	req.reply.Err = OK
+	pb.waitCommit(req.args.LSN, req.done, func() { req.reply.Err = ErrWrongServer })
+}
+
+// should we take entries from source? only from upstream, and only if it gave us our state
+func (pb *PBServer) admitUpstream(source string) bool {
+	if pb.isdead() {
+		return false
+	}
+	if time.Since(pb.impl.lastpingtime) > viewservice.PingInterval*viewservice.DeadPings {
+		return false
+	}
+	//we may have been left out of the view and missed entries
+	return source != "" && source == pb.upstream() && source == pb.impl.fed_by
+}
@@ -1,72 +1,315 @@
 package pbservice
 
-import "umich.edu/eecs491/proj2/viewservice"
+import (
+	"time"
+
+	"umich.edu/eecs491/proj2/shardctrl"
+	"umich.edu/eecs491/proj2/viewservice"
+)
 
 // Error values
 type Err string
 
 const (
-	OK             = "OK"             // Success
-	ErrNoKey       = "ErrNoKey"       // No key (Get only)
-	ErrWrongServer = "ErrWrongServer" // Wrong primary
+	OK               = "OK"               // Success
+	ErrNoKey         = "ErrNoKey"         // No key (Get, Delete and CompareAndSwap)
+	ErrWrongServer   = "ErrWrongServer"   // Wrong primary
+	ErrCompareFailed = "ErrCompareFailed" // Key held some other value (CompareAndSwap/PutIfAbsent)
+	ErrStale         = "ErrStale"         // Backup too far behind for a stale Get
+	ErrWrongGroup    = "ErrWrongGroup"    // Key's shard belongs to another replica group
+	ErrCompacted     = "ErrCompacted"     // Server no longer has the revision asked for (Watch, Get with AtRev)
+	ErrNoRev         = "ErrNoRev"         // Server has not got to the revision asked for (Get with AtRev)
+	ErrNotEmpty      = "ErrNotEmpty"      // Server already has data to lose (Restore)
 )
 
 // Operations
 type Op  string
 
 const (
-	GET        = "Get"
-	PUT        = "Put"
-	APPEND     = "Append"
+	GET         = "Get"
+	PUT         = "Put"
+	APPEND      = "Append"
+	DELETE      = "Delete"
+	CAS         = "CompareAndSwap"
+	PUTIFABSENT = "PutIfAbsent"
+	SCAN        = "Scan"
+	EXPIRE      = "Expire" // Primary to Backup only: a TTL ran out
 )
 
-// An Operation: Get, Put, or Append
+// most pairs a single Scan returns
+const MaxScan = 1000
+
+// most operations a Clerk puts in a single Batch
+const MaxBatch = 100
+
+// An Operation: Get, Scan, Put, Append, Delete, CompareAndSwap or PutIfAbsent
 //
-// This can be sent from Client to Primary, or
-// from Primary to Backup
+// Sent from Client to Primary. The Primary decides the outcome
+// of each mutation and passes it on to the Backup in a Replicate,
+// so that the Backup applies exactly what the Primary did instead
+// of working it out again (CompareAndSwap and PutIfAbsent depend
+// on the current value).
 
 // Operation Arguments
 type OpArgs struct {
-	Op      Op       // Operation being performed
-	Key     string   // Key being fetched/modified
-	Value   string   // Value to Put/Append (if modification)
-	Client  string   // Identifier for client requesting this operation
-	SeqNo   int      // Sequence # of this operation on this client
-	Source  string   // Source of this call (Client ID or Primary ID)
+	Op       Op            // Operation being performed
+	Key      string        // Key being fetched/modified
+	Value    string        // Value to Put/Append (if modification)
+	TTL      time.Duration // Put only: expire the key this long after the Put, 0 for never
+	Expected string        // Value the key must hold (CompareAndSwap only)
+	End      string        // Scan keys from Key up to (not including) End, "" for no end
+	Limit    int           // Most pairs to Scan, <= 0 for MaxScan
+	Client   string        // Identifier for client requesting this operation
+	SeqNo    int           // Sequence # of this operation on this client
+	Acked    int           // Client has the replies to its operations up through this SeqNo
+	MaxStale time.Duration // Get only: a Backup may answer, if no more out of date than this
+	MinLSN   int64         // Get with MaxStale: the answer must reflect this log entry
+	AtRev    int64         // Get only: read the key as of this revision, 0 for the latest
+	Source   string        // Source of this call (Client ID)
 }
 
 // Operation Results
 type OpReply struct {
 	Err    Err       // One of the Err codes
-	Value  string    // value of key (Get only)
+	Value  string    // value of key (Get, and current value after CompareAndSwap/PutIfAbsent)
+	                 // for Scan, where the next page starts ("" if there is none)
+	Values []string  // values of the keys read (Transaction only)
+	Pairs  []KeyValue // keys and values in order (Scan only)
+	Viewnum uint     // view # of the server that answered
+	LSN    int64     // the log entry the answer reflects (a write: its own)
+	Rev    int64     // Get: revision of the write that gave the key its value (see store.go)
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+	Rev   int64 // revision of the key's latest write
+}
+
+// Transaction
+//
+// Reads, checks and writes several keys as one atomic step on
+// the Primary, which replicates it to the Backup as a unit. The
+// Reads see the database before any of the Writes. The Writes
+// are applied only if every Cond holds; otherwise the reply is
+// ErrCompareFailed (and still carries the Reads).
+
+type Cond struct {
+	Key    string
+	Exists bool   // false: Key must be absent
+	Value  string // value Key must hold (if Exists)
+	Rev    int64  // if not 0, instead of Value: the revision of Key's latest write (see Get)
+}
+
+type Write struct {
+	Op    Op     // PUT, APPEND or DELETE
+	Key   string
+	Value string
+}
+
+type TxnArgs struct {
+	Reads   []string  // keys to read
+	Conds   []Cond    // conditions that must all hold
+	Writes  []Write   // applied in order, if the Conds hold
+	Client  string    // Identifier for client requesting this transaction
+	SeqNo   int       // Sequence # on this client, shared with Operations
+	Acked   int       // Client has the replies up through this SeqNo
+	Source  string    // Source of this call (Client ID)
+}
+
+// Batch
+//
+// Several mutations, from one or more of a client's goroutines,
+// in one RPC (see batch.go). Each is numbered as if sent on its
+// own, and the Primary applies them in order, as a unit. Replies
+// has a result for each; Err other than OK is for the whole batch,
+// none of which may be assumed to have happened.
+
+type BatchArgs struct {
+	Ops    []OpArgs // PUT, APPEND, DELETE, CAS or PUTIFABSENT, in order
+	Source string   // Source of this call (Client ID)
+}
+
+type BatchReply struct {
+	Err     Err
+	Replies []OpReply // what each of Ops returned
+	Viewnum uint      // view # of the server that answered
+	LSN     int64     // the log entry of the batch
+}
+
+// Watch
+//
+// Ask the Primary for the changes to Key (or, with Prefix, to every
+// key that starts with it) after revision After, or after the
+// latest one if Now (see watch.go). The Primary answers once it
+// has some committed, or after a while with none. Either way Rev
+// says how far the answer goes: the next Watch carries on from it.
+
+type Event struct {
+	Op      Op     // PUT, APPEND or DELETE (a key that expired shows up as a DELETE)
+	Key     string
+	Value   string // the value Put or Appended
+	Viewnum uint   // view # of the Primary that logged it
+	Rev     int64  // the store revision it made (see store.go)
+	LSN     int64  // the log entry it was in, shared by the changes of one Transaction or Batch
+}
+
+type WatchArgs struct {
+	Key    string
+	Prefix bool   // watch every key that starts with Key
+	After  int64  // the last revision the client has seen
+	Now    bool   // ignore After, start from the latest revision
+	Source string // Source of this call (Client ID)
+}
+
+type WatchReply struct {
+	Err     Err
+	Events  []Event // in revision order
+	Rev     int64   // the answer has every change up through this revision
+	Viewnum uint    // view # of the server that answered
+}
+
+// Backup and Restore
+//
+// Ask the Primary for a copy of the whole database, as of the last
+// entry it applied (see backup.go). Or hand one to the Primary of a
+// fresh cluster to start from, one page at a time like a Push. A
+// Primary that already has data answers ErrNotEmpty.
+
+type Backup struct {
+	Viewnum  uint                 // view # of the Primary that took it
+	LSN      int64                // the last log entry it includes
+	Taken    time.Time            // when the Primary took it
+	KVStore  []KeyValue           // every key, in order
+	Versions map[string][]version // earlier values, deleted keys included (see store.go)
+	Rev      int64                // the store's revision
+	Forgot   int64                // the revision before which it may have dropped deletes
+	OpCache  []Result             // the cache of past results
+	Expires  map[string]time.Time // when the expiring keys in KVStore expire
+}
+
+type BackupArgs struct {
+	Source string // Source of this call (Client ID)
+}
+
+type BackupReply struct {
+	Err    Err
+	Backup Backup
+}
+
+type RestoreArgs struct {
+	Page   PushArgs // A page of the backup (only its items, Rev, Forgot, Version and Last)
+	Client string   // numbered like a mutation, so a resent last page is recognized
+	SeqNo  int
+	Acked  int
+	Source string
+}
+
+type RestoreReply struct {
+	Err     Err
+	Next    int   // Offset of the page the Primary wants next
+	Viewnum uint  // view # of the server that answered
+	LSN     int64 // once the last page is in, the restore's place in the log
 }
 
 // Each active server must remember the last successful response for
 // at least some operations from each client. The response is tagged
 // with the sequence number the client used to make the request
 //
-// Note that you might not need to remember *all* (types of) past
-// results...
+// Only results the client has not acked yet are kept (see dedup.go)
 
 type Result struct {
-	SeqNo int 
-	V     OpReply
+	Client string
+	Acked  int             // the client has the replies up through this SeqNo
+	V      map[int]OpReply // results of its later mutations, by SeqNo
 }
 
 // Push
 //
-// Send a copy of the current database from Primary to (new) Backup
+// Send a copy of the current database from Primary to (new) Backup,
+// one page at a time (see transfer.go)
 //
 // Includes the Key/Value store.
 // Must also include a way to identify repeated reqeusts
-// Define this in your rpcs_impl.go
 
 type PushArgs struct {
-	KVStore  map[string]string // The current DB at the caller
-	OpCache  map[string]Result // The current cache of past results
-	View     viewservice.View  // The current View at the caller
+	View     viewservice.View         // The current View at the caller
+	Source   string                   // The caller
+	Probe    bool                     // No state, just check the Backup still has the caller's
+	Version  int64                    // Which snapshot of the caller's state this page is from
+	LSN      int64                    // The last log entry the snapshot includes
+	Offset   int                      // Position of this page's first item in the snapshot
+	KVStore  []KeyValue               // Items of the snapshot: keys first, in order...
+	OpCache  []Result                 // ...then the cache of past results
+	Expires  map[string]time.Duration // Time left to live of the expiring keys in KVStore
+	Versions map[string][]version     // Earlier values of the keys in KVStore, and (Last) of deleted keys
+	Rev      int64                    // The store's revision (see store.go)
+	Forgot   int64                    // The revision before which it may have dropped deletes
+	Last     bool                     // This page completes the snapshot
+	Config   shardctrl.Config         // Shard config the caller is in (if sharded)
+	Shards   [shardctrl.NShards]int   // What the caller is doing with each shard
 }
 
 type PushReply struct {
+	Err  Err
+	Next int // Offset of the page the Backup wants next
+}
+
+// Replicate
+//
+// One entry of the Primary's log on its way to a Backup (in a
+// chain, from each server to its successor), see pipeline.go.
+// The Backup applies entries in LSN order and replies once it
+// has, so a reply acks every entry up to LSN.
+
+type ReplicateArgs struct {
+	Source  string           // The caller
+	LSN     int64            // Position of the entry in the log, from 1
+	Kind    int              // entryOp, entryTxn, entryBatch, entryNop or one of the shard entries
+	Op      OpArgs           // The mutation (entryOp)
+	Txn     TxnArgs          // The transaction (entryTxn)
+	Result  OpReply          // Outcome decided by the Primary
+	Batch   []OpArgs         // The mutations (entryBatch)
+	Results []OpReply        // Their outcomes (entryBatch)
+	Stamp   time.Time        // When the Primary logged the entry
+	Viewnum uint             // The Primary's view # at the time
+	Config  shardctrl.Config // The next shard config (entryConfig)
+	Shard   ShardArgs        // A shard coming in or going out (entryShardIn/Out)
+}
+
+type ReplicateReply struct {
 	Err Err
 }
+
+// Shard
+//
+// Hand a shard over from the Primary of the replica group that
+// served it to the Primary of the group that serves it in config
+// Num (see shard.go). Like a Push, but of one shard, in one go.
+
+type ShardArgs struct {
+	Num      int                      // Config in which the shard moves
+	Shard    int                      // Which shard
+	KVStore  []KeyValue               // Its keys and values
+	OpCache  []Result                 // The sender's cache of past results
+	Expires  map[string]time.Duration // Time left to live of the expiring keys in KVStore
+	Versions map[string][]version     // Earlier values of its keys, deleted keys included
+	Source   string                   // The caller, a server of the group that had the shard
+}
+
+type ShardReply struct {
+	Err Err
+}
+
+// On a TLS connection, the caller of each of these is who its
+// certificate says, whatever Source it filled in (see transport).
+
+func (args *OpArgs) SetCaller(name string)        { args.Source = name }
+func (args *TxnArgs) SetCaller(name string)       { args.Source = name }
+func (args *BatchArgs) SetCaller(name string)     { args.Source = name }
+func (args *WatchArgs) SetCaller(name string)     { args.Source = name }
+func (args *BackupArgs) SetCaller(name string)    { args.Source = name }
+func (args *RestoreArgs) SetCaller(name string)   { args.Source = name }
+func (args *PushArgs) SetCaller(name string)      { args.Source = name }
+func (args *ReplicateArgs) SetCaller(name string) { args.Source = name }
+func (args *ShardArgs) SetCaller(name string)     { args.Source = name }
@@ -6,11 +6,10 @@ import (
 	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
 	"sync/atomic"
-	"syscall"
 	"time"
 
+	"umich.edu/eecs491/proj2/transport"
 	"umich.edu/eecs491/proj2/viewservice"
 )
 
@@ -21,6 +20,7 @@ type PBServer struct {
 	unreliable int32 // for testing
 	me         string
 	vs         *viewservice.Clerk
+	creds      *transport.Creds // nil for no TLS
 
 	impl       PBServerImpl
 }
@@ -55,18 +55,53 @@ func (pb *PBServer) isunreliable() bool {
 	return atomic.LoadInt32(&pb.unreliable) != 0
 }
 
+// for each request: will an unreliable network lose it, or its reply?
+func (pb *PBServer) drop() (bool, bool) {
+	if !pb.isunreliable() {
+		return false, false
+	}
+	if (rand.Int63() % 1000) < 100 {
+		return true, false
+	}
+	return false, (rand.Int63() % 1000) < 200
+}
+
+// Optional server settings; the zero value gives the original
+// in-memory server.
+type Options struct {
+	Dir   string           // data directory for the write-ahead log, "" for none
+	Ctrl  string           // shard controller, "" if the key space is not sharded
+	GID   int64            // our replica group, with Ctrl
+	Creds *transport.Creds // TLS, with a certificate for our address (see transport)
+
+	// earlier values to keep per key, for Gets as of an earlier
+	// revision, and for how long (0 for no limit). see store.go
+	KeepVersions int
+	KeepFor      time.Duration
+}
+
 func StartServer(vshost string, me string, term <-chan interface{}) *PBServer {
+	return StartServerWithOptions(vshost, me, Options{}, term)
+}
+
+//
+// start a server that keeps its database in opts.Dir. if the
+// directory already holds a log, the server replays it before
+// serving and reports the recovered view to the viewservice.
+//
+func StartServerWithOptions(vshost string, me string, opts Options,
+	term <-chan interface{}) *PBServer {
 	pb := new(PBServer)
 	pb.dead = term
 	pb.me = me
-	pb.vs = viewservice.MakeClerk(me, vshost)
-	pb.initImpl()
+	pb.creds = opts.Creds
+	pb.vs = viewservice.MakeClerkWithCreds(me, vshost, opts.Creds)
+	pb.initImpl(opts)
 
 	rpcs := rpc.NewServer()
 	rpcs.Register(pb)
 
-	os.Remove(pb.me)
-	l, e := net.Listen("unix", pb.me)
+	l, e := opts.Creds.Listen(pb.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -87,24 +122,10 @@ func StartServer(vshost string, me string, term <-chan interface{}) *PBServer {
 				fmt.Printf("PBServer(%v) accept: %v\n", me, err.Error())
 				continue
 			}
-			// We are not dead, and have a valid connection
-			// Did an unreliable network  cause the request to fail?
-			if pb.isunreliable() && (rand.Int63()%1000) < 100 {
-				// yes: discard it and do not process
-				conn.Close()
-				continue
-			}
-			// Will an unreliable network cause the response to fail?
-			if pb.isunreliable() && (rand.Int63()%1000) < 200 {
-				// yes: close file descriptor over which response will be sent
-				c1 := conn.(*net.UnixConn)
-				f, _ := c1.File()
-				err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-				if err != nil {
-					fmt.Printf("shutdown: %v\n", err)
-				}
-			}
-			go rpcs.ServeConn(conn)
+			// We are not dead, and have a valid connection.
+			// Clients keep it for many requests, so an unreliable
+			// network loses those one at a time (see drop)
+			go transport.ServeUnreliable(rpcs, conn, pb.drop)
 		}
 	}()
 
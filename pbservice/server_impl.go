@@ -1,9 +1,9 @@
 package pbservice
 import (
+	"umich.edu/eecs491/proj2/shardctrl"
 	"umich.edu/eecs491/proj2/viewservice"
+    "log"
     "time"
-    "strconv"
-    "strings"
 )
 
 type opReq struct {
@@ -12,51 +12,227 @@ type opReq struct {
 	done  chan bool
 }
 
+type txnReq struct {
+	args  TxnArgs
+	reply *OpReply
+	done  chan bool
+}
+
 type pushReq struct {
 	args  PushArgs
 	reply *PushReply
 	done  chan bool
 }
 
+type batchReq struct {
+	args  BatchArgs
+	reply *BatchReply
+	done  chan bool
+}
+
+type watchReq struct {
+	args  WatchArgs
+	reply *WatchReply
+	done  chan bool
+	since time.Time // when it got here
+}
+
+type backupReq struct {
+	args  BackupArgs
+	reply *BackupReply
+	done  chan bool
+}
+
+type restoreReq struct {
+	args  RestoreArgs
+	reply *RestoreReply
+	done  chan bool
+}
+
 type tickReq struct {
 	done chan bool
 }
 
 type PBServerImpl struct {
-    kv           map[string]string
-    results      map[string]map[int]OpReply
+    kv           *store
+    results      map[string]clientResult // latest result per client (see dedup.go)
+    lastsweep    time.Time                // when we last looked for idle clients
+    expires      map[string]time.Time // deadline of each key written with a TTL
+    deadlines    expiryHeap           // the same deadlines, soonest first (see expire.go)
     view         viewservice.View
     lastpingtime time.Time
-    
+    lease        time.Time // as primary, we answer reads ourselves until then (see lease.go)
+
+    wal          *persister // nil if running without a data directory
+    recovered    uint       // view # of the state replayed from disk, until we rejoin
+    stateview    uint       // view # of the state we hold: the last view we were primary in, or were fed in whole
+    acked        uint       // view # we last pinged the viewservice with
+
+    lsn          int64                // the last log entry we applied (see pipeline.go)
+    commit       int64                // every server downstream of us has applied the entries up through this one
+    stamp        time.Time            // when the primary logged the last entry we applied (see stale.go)
+    logview      uint                 // the primary's view # when it logged that entry
+    waiting      []waiter             // replies held back until their entry commits
+    held         map[int64][]*replReq // entries from upstream that came before their turn
+    streams      map[string]*stream   // as primary, our link to each backup
+    receiving    *incoming            // as backup, the state the primary is sending us (see transfer.go)
+    restoring    *incoming            // as primary, the backup a Clerk is restoring (see backup.go)
+    fed_by       string               // who sent us the state we have, "" if we may have missed some
+
+    ctrl         *shardctrl.Clerk       // nil if the key space is not sharded (see shard.go)
+    gid          int64                  // our replica group
+    config       shardctrl.Config       // the shard config we are in
+    shards       [shardctrl.NShards]int // what we are doing with each shard in it
+    conflsn      int64                  // the entry that moved us to config
+    handing      map[int]bool           // as primary, shards we are handing over right now
+    polling      bool                   // as primary, asking the controller for the next config right now
+
+    changes      []Event      // what the latest entries changed (see watch.go)
+    history      int64        // changes has every change after this revision
+    watchers     []*watchReq  // as primary, watches waiting for a change
+
     // Channels for serialization
     op_chan    chan *opReq
+    txn_chan   chan *txnReq
+    batch_chan chan *batchReq
+    watch_chan chan *watchReq
+    backup_chan  chan *backupReq
+    restore_chan chan *restoreReq
     push_chan  chan *pushReq
     tick_chan  chan *tickReq
+    repl_chan  chan *replReq
+    stream_chan chan *streamMsg
+    shard_chan  chan *shardReq
+    handed_chan chan *handedMsg
+    config_chan chan *configMsg
 }
 
-func (pb *PBServer) initImpl() {
-	pb.impl.kv = make(map[string]string)
-	pb.impl.results = make(map[string]map[int]OpReply)
+func (pb *PBServer) initImpl(opts Options) {
+	pb.impl.kv = newStore()
+	pb.impl.results = make(map[string]clientResult)
+    pb.impl.expires = make(map[string]time.Time)
+    pb.impl.held = make(map[int64][]*replReq)
+    pb.impl.streams = make(map[string]*stream)
+    pb.impl.handing = make(map[int]bool)
+    if opts.Ctrl != "" {
+        pb.impl.ctrl = shardctrl.MakeClerk(opts.Ctrl)
+        pb.impl.gid = opts.GID
+    }
     pb.impl.lastpingtime = time.Now()
     //this is to make sure we're not overpinging
 
+    pb.impl.kv.retain(opts.KeepVersions, opts.KeepFor)
+    pb.recover(opts.Dir)
+    //before the replay, which keeps versions like any other write
+
     // initialize chans
     pb.impl.op_chan = make(chan *opReq)
+    pb.impl.txn_chan = make(chan *txnReq)
+    pb.impl.batch_chan = make(chan *batchReq)
+    pb.impl.watch_chan = make(chan *watchReq)
+    pb.impl.backup_chan = make(chan *backupReq)
+    pb.impl.restore_chan = make(chan *restoreReq)
     pb.impl.push_chan = make(chan *pushReq)
     pb.impl.tick_chan = make(chan *tickReq)
+    pb.impl.repl_chan = make(chan *replReq)
+    pb.impl.stream_chan = make(chan *streamMsg)
+    pb.impl.shard_chan = make(chan *shardReq)
+    pb.impl.handed_chan = make(chan *handedMsg)
+    pb.impl.config_chan = make(chan *configMsg)
     
     // start run_channels goroutine
     go pb.run_channels()
 }
 
+// load the snapshot and replay the wal left behind in dir (if any)
+func (pb *PBServer) recover(dir string) {
+    ps, err := openPersister(dir)
+    if err != nil {
+        log.Fatal("open data dir: ", err)
+    }
+    snap, entries, err := ps.load()
+    if err != nil {
+        log.Fatal("load data dir: ", err)
+    }
+    pb.impl.wal = ps
+
+    if snap.KV != nil {
+        kv := storeFrom(snap.KV, snap.Revs, snap.Versions)
+        kv.setRev(snap.Rev, snap.Forgot)
+        kv.retain(pb.impl.kv.keep, pb.impl.kv.keepFor)
+        pb.impl.kv = kv
+    }
+    if snap.Results != nil {
+        pb.impl.results = snap.Results
+    }
+    for key, deadline := range snap.Expires {
+        pb.setDeadline(key, deadline)
+    }
+    pb.impl.recovered = snap.Viewnum
+    pb.impl.config = snap.Config
+    pb.impl.shards = snap.Shards
+    for i := range entries {
+        switch entries[i].Kind {
+        case entryOp:
+            pb.applyOp(&entries[i].Args, entries[i].Reply, entries[i].Deadline)
+        case entryTxn:
+            pb.applyTxn(&entries[i].Txn, entries[i].Reply)
+        case entryBatch:
+            pb.applyBatch(entries[i].Batch, entries[i].Replies, entries[i].Deadlines)
+        case entryView:
+            pb.impl.recovered = entries[i].Viewnum
+        case entryConfig, entryShardIn, entryShardOut:
+            pb.applyShard(&entries[i])
+        }
+    }
+    pb.impl.stateview = pb.impl.recovered
+    pb.resetChanges(pb.impl.kv.rev)
+    //the replayed entries have no LSNs to watch them by
+    //we still start out at view 0, the viewservice decides whether to trust us
+}
+
 // processes all state modifications
 func (pb *PBServer) run_channels() {
 	for {
 		select {
 		case req := <-pb.impl.op_chan:
-			pb.operationImpl(&req.args, req.reply)
-			req.done <- true
+			lsn := pb.operationImpl(&req.args, req.reply)
+			if lsn > 0 {
+				req.reply.Viewnum, req.reply.LSN = pb.impl.view.Viewnum, lsn
+			}
+			pb.waitCommit(lsn, req.done, func() { req.reply.Err = ErrWrongServer })
+			//answer once what the reply depends on has reached the backups
+
+		case req := <-pb.impl.txn_chan:
+			lsn := pb.transactionImpl(&req.args, req.reply)
+			if lsn > 0 {
+				req.reply.Viewnum, req.reply.LSN = pb.impl.view.Viewnum, lsn
+			}
+			pb.waitCommit(lsn, req.done, func() { req.reply.Err = ErrWrongServer })
+
+		case req := <-pb.impl.batch_chan:
+			lsn := pb.batchImpl(&req.args, req.reply)
+			if lsn > 0 {
+				req.reply.Viewnum, req.reply.LSN = pb.impl.view.Viewnum, lsn
+			}
+			pb.waitCommit(lsn, req.done, func() { req.reply.Err = ErrWrongServer })
 			
+		case req := <-pb.impl.watch_chan:
+			pb.watchImpl(req)
+			//replies once there is a change to report, or after watchPoll
+
+		case req := <-pb.impl.backup_chan:
+			lsn := pb.backupImpl(&req.args, req.reply)
+			pb.waitCommit(lsn, req.done, func() { req.reply.Err = ErrWrongServer })
+			//a backup of writes that could still be lost is no backup
+
+		case req := <-pb.impl.restore_chan:
+			lsn := pb.restoreImpl(&req.args, req.reply)
+			if lsn > 0 {
+				req.reply.Viewnum, req.reply.LSN = pb.impl.view.Viewnum, lsn
+			}
+			pb.waitCommit(lsn, req.done, func() { req.reply.Err = ErrWrongServer })
+
 		case req := <-pb.impl.push_chan:
 			pb.pushImpl(&req.args, req.reply)
 			req.done <- true
@@ -64,6 +240,27 @@ func (pb *PBServer) run_channels() {
 		case req := <-pb.impl.tick_chan:
 			pb.tickImpl()
 			req.done <- true
+
+		case req := <-pb.impl.repl_chan:
+			pb.replicateImpl(req)
+			//replies once the entry commits
+
+		case msg := <-pb.impl.stream_chan:
+			pb.streamImpl(msg)
+			msg.done <- true
+
+		case req := <-pb.impl.shard_chan:
+			lsn := pb.shardImpl(&req.args, req.reply)
+			pb.waitCommit(lsn, req.done, func() { req.reply.Err = ErrWrongServer })
+			//the old owner may drop the shard once we ack, so it has to be on our backups
+
+		case msg := <-pb.impl.handed_chan:
+			pb.handedImpl(msg)
+			msg.done <- true
+
+		case msg := <-pb.impl.config_chan:
+			pb.configImpl(msg)
+			msg.done <- true
 		}
 	}
 }
@@ -80,49 +277,68 @@ func (pb *PBServer) Operation(args OpArgs, reply *OpReply) error {
 	return nil
 }
 
-// what operation() does (runs in run_channels goroutine)
-func (pb *PBServer) operationImpl(args *OpArgs, reply *OpReply) {
+// should we handle a client's request?
+func (pb *PBServer) admit(read bool) bool {
     if pb.isdead() {
-        reply.Err = ErrWrongServer
-        return
+        return false
     }
     //if dead dont do anything
+
+    if read && pb.me == pb.impl.view.Primary && pb.servesReads() {
+        return true
+    }
+    //the primary's reads go by its lease instead (see lease.go)
     
     time_since_last_ping := time.Since(pb.impl.lastpingtime)
     if time_since_last_ping > viewservice.PingInterval * viewservice.DeadPings {
-        reply.Err = ErrWrongServer
-        return
+        return false
     }
     //if too long, it's dead
 
-    from_primary := (args.Source == pb.impl.view.Primary) //if the request was from primary
-    if args.Source == "" {
-        if pb.me != pb.impl.view.Primary {
-            reply.Err = ErrWrongServer
-            return
-        } // if no source id and it is not primary, error
-    } else {
-        if !(pb.me == pb.impl.view.Backup && from_primary) && !(pb.me == pb.impl.view.Primary && args.Source == pb.impl.view.Primary) {
-            if pb.me != pb.impl.view.Primary {
-                reply.Err = ErrWrongServer
-                return
-            }
-        }// if not backup && source is from primary && not primary && source is from primary, err
+    if read {
+        return pb.servesReads()
     }
+    return pb.me == pb.impl.view.Primary
+    // clients write through the primary only, and read from it unless there is a chain
+}
 
-    _, ok := pb.impl.results[args.Client]
-    if !ok {
-        pb.impl.results[args.Client] = make(map[int]OpReply)
+//
+// what operation() does (runs in run_channels goroutine). returns
+// the LSN that has to commit before the reply goes out, 0 for none.
+//
+func (pb *PBServer) operationImpl(args *OpArgs, reply *OpReply) int64 {
+    if args.Op == GET && args.MaxStale > 0 && pb.me != pb.impl.view.Primary {
+        pb.staleGet(args, reply)
+        return 0
     }
-    //now put it all into results
+    //a backup may answer a Get that can live with an old value
 
-    
-    cached, ok := pb.impl.results[args.Client][args.SeqNo]
-    if ok {
-        *reply = cached
-        return
+    if !pb.admit(args.Op == GET || args.Op == SCAN) {
+        reply.Err = ErrWrongServer
+        return 0
     }
-    // check for the seq number match
+
+    if args.Op != SCAN && !pb.owns(args.Key) {
+        reply.Err = ErrWrongGroup
+        return 0
+    }
+    //a Scan just leaves out the keys we do not serve
+
+    if pb.me == pb.impl.view.Primary && !pb.expireDue() {
+        reply.Err = ErrWrongServer
+        return 0
+    }
+    //as primary, get rid of expired keys before anyone can see them
+
+    pb.ackResults(args.Client, args.Acked)
+    if args.Op != GET && args.Op != SCAN {
+        cached, lsn, ok := pb.cachedResult(args.Client, args.SeqNo)
+        if ok {
+            *reply = cached
+            return lsn
+        }
+    }
+    // check for the seq number match, reads are never cached so just do them again
 
     // no cache, then new operation
     
@@ -130,104 +346,283 @@ func (pb *PBServer) operationImpl(args *OpArgs, reply *OpReply) {
 
     switch args.Op {
     case GET:
-        val, ok := pb.impl.kv[args.Key]
-        if ok {
-            result = OpReply{Err: OK, Value: val}
-        } else {
-            result = OpReply{Err: ErrNoKey, Value: ""}
+        *reply = pb.readKey(args)
+        return pb.readLSN(reply)  //DO NOT CACHE GETS OH MY GOD
+
+    case SCAN:
+        limit := args.Limit
+        if limit <= 0 || limit > MaxScan {
+            limit = MaxScan
+        }
+        pairs := pb.impl.kv.scan(args.Key, args.End, limit+1)
+        result = OpReply{Err: OK}
+        if len(pairs) > limit {
+            pairs = pairs[:limit]
+            result.Value = pairs[limit-1].Key + "\x00"
         }
+        //Value is where the next page starts, the smallest key after the last one returned
+        result.Pairs = pb.ownedOnly(pb.liveOnly(pairs))
         *reply = result
-        return  //DO NOT CACHE GETS OH MY GOD
+        return pb.readLSN(reply)  //not cached either, same as a Get
 
-    case PUT:
-        // if we're backup and forwarded from primary, apply locally and then cache
-        if pb.me == pb.impl.view.Backup && from_primary {
-            _, ok := pb.impl.results[args.Client]
-            if !ok {
-                pb.impl.results[args.Client] = make(map[int]OpReply)
-            }
-            cached, ok := pb.impl.results[args.Client][args.SeqNo]
-            if ok {
-                *reply = cached
-                return
-            }//FOR AVOIDING DOUBLE APPENDS, if cached, return the cached
-
-            pb.impl.kv[args.Key] = args.Value
-            result = OpReply{Err: OK}
-            pb.impl.results[args.Client][args.SeqNo] = result
-        } else {
-            // primary: if there is a backup we need to forward first and only apply locally after backup ack done
-            if pb.impl.view.Backup != "" && pb.impl.view.Backup != pb.me {
-                fwd := *args
-                fwd.Source = pb.me
-                var fwdReply OpReply
-                ok := call(pb.impl.view.Backup, "PBServer.Operation", &fwd, &fwdReply) //if still alive
-                if !ok || fwdReply.Err != OK {
-                    // forward must have failed so tell the client to retry or view change
-                    reply.Err = ErrWrongServer
-                    return
-                }
-                // backup applied successfully, now apply locally
-                pb.impl.kv[args.Key] = args.Value
-                result = OpReply{Err: OK}
-                // cache only now
-                pb.impl.results[args.Client][args.SeqNo] = result
-            } else {
-                // no backup: apply locally & cache
-                pb.impl.kv[args.Key] = args.Value
-                result = OpReply{Err: OK}
-                pb.impl.results[args.Client][args.SeqNo] = result
-            }
+    case PUT, APPEND, DELETE, CAS, PUTIFABSENT:
+        result = pb.decide(args)
+        // apply it now so the next op sees it, the reply waits for the backups
+        lsn, ok := pb.submit(ReplicateArgs{Kind: entryOp, Op: *args, Result: result})
+        if !ok {
+            reply.Err = ErrWrongServer
+            return 0
         }
+        *reply = result
+        return lsn
 
-    case APPEND:
-        if pb.me == pb.impl.view.Backup && from_primary { //if from primary and we're backup
-            _, ok := pb.impl.results[args.Client]
-            if !ok {
-                pb.impl.results[args.Client] = make(map[int]OpReply)
-            }//create cache
-            cached, ok := pb.impl.results[args.Client][args.SeqNo]
-            if ok {
-                *reply = cached
-                return
-            } //FOR AVOIDING DOUBLE APPENDS, we return the cached result if true
-            pb.impl.kv[args.Key] += args.Value
-            result = OpReply{Err: OK}
-            pb.impl.results[args.Client][args.SeqNo] = result
-        } else {
-            if pb.impl.view.Backup != "" && pb.impl.view.Backup != pb.me {
-                fwd := *args
-                fwd.Source = pb.me
-                var fwdReply OpReply
-                ok := call(pb.impl.view.Backup, "PBServer.Operation", &fwd, &fwdReply) //if still alive
-                if !ok || fwdReply.Err != OK {
-                    reply.Err = ErrWrongServer
-                    return
-                }
-                // backup acked, now apply locally
-                pb.impl.kv[args.Key] += args.Value
-                result = OpReply{Err: OK}
-                pb.impl.results[args.Client][args.SeqNo] = result
-            } else {
-                // no backup
-                pb.impl.kv[args.Key] += args.Value
-                result = OpReply{Err: OK}
-                pb.impl.results[args.Client][args.SeqNo] = result
-            }
+    default:
+        result = OpReply{Err: ErrWrongServer}
+        //EXPIRE included, only the primary itself makes those
+    }
+
+    *reply = result
+    return 0
+}
+
+// what a Get of args.Key finds, now or as of args.AtRev
+func (pb *PBServer) readKey(args *OpArgs) OpReply {
+    if args.AtRev > 0 {
+        val, rev, ok, err := pb.impl.kv.at(args.Key, args.AtRev)
+        if err != OK {
+            return OpReply{Err: err}
+        }
+        if !ok {
+            return OpReply{Err: ErrNoKey, Rev: rev}
+        }
+        return OpReply{Err: OK, Value: val, Rev: rev}
+    }
+    //Rev is the write that gave the answer, a delete for ErrNoKey
+
+    val, rev, ok := pb.impl.kv.lookup(args.Key)
+    if ok && pb.live(args.Key) {
+        return OpReply{Err: OK, Value: val, Rev: rev}
+    }
+    return OpReply{Err: ErrNoKey, Value: ""}
+}
+
+// work out the result of a mutation against the current kv, without changing anything
+func (pb *PBServer) decide(args *OpArgs) OpReply {
+    return decideWith(args, pb.impl.kv.get)
+}
+
+// decide(), against whatever get says the keys hold
+func decideWith(args *OpArgs, get func(string) (string, bool)) OpReply {
+    cur, ok := get(args.Key)
+    switch args.Op {
+    case DELETE:
+        if !ok {
+            return OpReply{Err: ErrNoKey}
+        }
+    case CAS:
+        if !ok {
+            return OpReply{Err: ErrNoKey}
+        }
+        if cur != args.Expected {
+            return OpReply{Err: ErrCompareFailed, Value: cur}
+        }
+        return OpReply{Err: OK, Value: args.Value}
+    case PUTIFABSENT:
+        if ok {
+            return OpReply{Err: ErrCompareFailed, Value: cur}
         }
+        return OpReply{Err: OK, Value: args.Value}
+    }
+    return OpReply{Err: OK}
+}
+
+// log a mutation and then apply it, false if the log could not be written
+func (pb *PBServer) commitOp(args *OpArgs, result OpReply) bool {
+    deadline := deadlineFor(args)
+    err := pb.impl.wal.appendEntry(walEntry{Kind: entryOp, Args: *args, Reply: result, Deadline: deadline})
+    if err != nil {
+        log.Printf("%s: wal append: %v\n", pb.me, err)
+        return false
+    }
+    pb.applyOp(args, result, deadline)
+    pb.compact()
+    return true
+}
+
+// keep the wal short by folding it into a new snapshot now and then
+func (pb *PBServer) compact() {
+    if pb.impl.wal != nil && pb.impl.wal.entries >= compactEvery {
+        pb.saveSnapshot()
+    }
+}
+
+// apply a mutation to kv and cache its result
+// (also used for wal replay, so applying a cached op again is a no-op)
+func (pb *PBServer) applyOp(args *OpArgs, result OpReply, deadline time.Time) {
+    if args.Op == EXPIRE {
+        pb.applyWrite(EXPIRE, args.Key, "", time.Time{})
+        return
+    }
+    //expirations come from the primary itself, nothing to cache
 
+    pb.ackResults(args.Client, args.Acked)
+    //the backups (and wal replay) learn what the client acked from the log
+    if pb.applied(args.Client, args.SeqNo) {
+        return
+    } //FOR AVOIDING DOUBLE APPENDS
+
+    switch args.Op {
+    case CAS, PUTIFABSENT:
+        if result.Err == OK {
+            pb.applyWrite(PUT, args.Key, args.Value, time.Time{})
+        }
     default:
-        result = OpReply{Err: ErrWrongServer}
+        pb.applyWrite(args.Op, args.Key, args.Value, deadline)
     }
+    pb.recordResult(args.Client, args.SeqNo, result)
+}
 
-// only cache the results when doing the direct client requests
-    if args.Source == "" {
-        pb.impl.results[args.Client][args.SeqNo] = result
+// a Put replaces any TTL with deadline (zero for none), an Append leaves it alone
+func (pb *PBServer) applyWrite(op Op, key string, value string, deadline time.Time) {
+    switch op {
+    case PUT:
+        pb.impl.kv.put(key, value)
+        pb.setDeadline(key, deadline)
+        pb.recordChange(PUT, key, value)
+    case APPEND:
+        cur, _ := pb.impl.kv.get(key)
+        pb.impl.kv.put(key, cur+value)
+        pb.recordChange(APPEND, key, value)
+    case DELETE, EXPIRE:
+        _, ok := pb.impl.kv.get(key)
+        pb.impl.kv.del(key)
+        pb.setDeadline(key, time.Time{})
+        if ok {
+            pb.recordChange(DELETE, key, "")
+        }
     }
-    
+}
+
+// write the whole database to disk and start a fresh wal, as of the
+// view whose state we hold rather than the view we are in, which a
+// backup nobody has fed yet knows of without having its state
+func (pb *PBServer) saveSnapshot() {
+    snap := snapshot{
+        KV:       pb.impl.kv.toMap(),
+        Revs:     pb.impl.kv.revs(),
+        Versions: pb.impl.kv.versions(),
+        Rev:      pb.impl.kv.rev,
+        Forgot:   pb.impl.kv.forgot,
+        Results: pb.impl.results,
+        Expires: pb.impl.expires,
+        Viewnum: pb.impl.stateview,
+        Config:  pb.impl.config,
+        Shards:  pb.impl.shards,
+    }
+    err := pb.impl.wal.saveSnapshot(snap)
+    if err != nil {
+        log.Printf("%s: save snapshot: %v\n", pb.me, err)
+    }
+}
+
+
+// Transaction() sends the req through the channel, like Operation()
+func (pb *PBServer) Transaction(args TxnArgs, reply *OpReply) error {
+	req := &txnReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+	}
+	pb.impl.txn_chan <- req
+	<-req.done
+	return nil
+}
+
+// what transaction() does (runs in run_channels goroutine)
+// same path as a mutation in operationImpl, just with many keys
+func (pb *PBServer) transactionImpl(args *TxnArgs, reply *OpReply) int64 {
+    if !pb.admit(false) || !pb.expireDue() {
+        reply.Err = ErrWrongServer
+        return 0
+    }
+    //reads and conds must not see a key past its deadline, like operationImpl
+
+    for _, key := range txnKeys(args) {
+        if !pb.owns(key) {
+            reply.Err = ErrWrongGroup
+            return 0
+        }
+    }
+    //every key has to be in a shard of ours
+
+    pb.ackResults(args.Client, args.Acked)
+    cached, lsn, ok := pb.cachedResult(args.Client, args.SeqNo)
+    if ok {
+        *reply = cached
+        return lsn
+    }
+
+    result := pb.decideTxn(args)
+    lsn, ok = pb.submit(ReplicateArgs{Kind: entryTxn, Txn: *args, Result: result})
+    if !ok {
+        reply.Err = ErrWrongServer
+        return 0
+    }
+
     *reply = result
+    return lsn
 }
 
+// do the reads and check the conditions of a transaction
+func (pb *PBServer) decideTxn(args *TxnArgs) OpReply {
+    result := OpReply{Err: OK, Values: make([]string, len(args.Reads))}
+    for i, key := range args.Reads {
+        result.Values[i], _ = pb.impl.kv.get(key)
+    }
+    for _, c := range args.Conds {
+        cur, rev, ok := pb.impl.kv.lookup(c.Key)
+        held := ok == c.Exists
+        if ok && c.Exists {
+            held = cur == c.Value
+            if c.Rev != 0 {
+                held = rev == c.Rev
+            }
+        }
+        //a Rev stands in for the value
+        if !held {
+            result.Err = ErrCompareFailed
+            break
+        }
+    }
+    return result
+}
+
+// log a transaction and then apply it, like commitOp()
+func (pb *PBServer) commitTxn(args *TxnArgs, result OpReply) bool {
+    err := pb.impl.wal.appendEntry(walEntry{Kind: entryTxn, Txn: *args, Reply: result})
+    if err != nil {
+        log.Printf("%s: wal append: %v\n", pb.me, err)
+        return false
+    }
+    pb.applyTxn(args, result)
+    pb.compact()
+    return true
+}
+
+// apply the writes of a transaction (if its conditions held) and cache its result
+func (pb *PBServer) applyTxn(args *TxnArgs, result OpReply) {
+    pb.ackResults(args.Client, args.Acked)
+    if pb.applied(args.Client, args.SeqNo) {
+        return
+    }
+
+    if result.Err == OK {
+        for _, w := range args.Writes {
+            pb.applyWrite(w.Op, w.Key, w.Value, time.Time{})
+        }
+    }
+    pb.recordResult(args.Client, args.SeqNo, result)
+}
 
 // push() sends request through channel
 func (pb *PBServer) Push(args PushArgs, reply *PushReply) error {
@@ -243,7 +638,16 @@ func (pb *PBServer) Push(args PushArgs, reply *PushReply) error {
 
 // actual push() logic (runs in goroutine)
 func (pb *PBServer) pushImpl(args *PushArgs, reply *PushReply) {
-    if pb.me != pb.impl.view.Backup {
+    if args.Probe {
+        reply.Err = OK
+        if pb.impl.fed_by != args.Source {
+            reply.Err = ErrWrongServer
+        }
+        return
+    }
+    //does the sender still count on us having its state?
+
+    if !pb.impl.view.IsBackup(pb.me) {
         reply.Err = ErrWrongServer
         return
     }
@@ -253,31 +657,13 @@ func (pb *PBServer) pushImpl(args *PushArgs, reply *PushReply) {
         return
     }
 
-    pb.impl.kv = make(map[string]string)
-    for k, v := range args.KVStore {
-        pb.impl.kv[k] = v
+    if args.Source != pb.upstream() || args.View.Primary != pb.impl.view.Primary {
+        reply.Err = ErrWrongServer
+        return
     }
-    //push it
-
-    pb.impl.results = make(map[string]map[int]OpReply)
-	for key, result := range args.OpCache {
-		// string parsing the key to get client ID, in the form clientID-seqno
-		parts := strings.Split(key, "-")
-		if len(parts) < 2 {
-			continue
-		}
-		//client ID might have dashes, rejoin all but the last part
-
-		client := strings.Join(parts[:len(parts)-1], "-")
-		_, ok := pb.impl.results[client]
-		if !ok {
-			pb.impl.results[client] = make(map[int]OpReply)
-		}
-        pb.impl.results[client][result.SeqNo] = result.V
-	}
+    //only whoever feeds us in the view we know of may replace our state
 
-    pb.impl.view = args.View
-    reply.Err = OK
+    pb.receivePage(args, reply)
 }
 
 // tick() sends request through channel
@@ -296,46 +682,63 @@ func (pb *PBServer) tickImpl() {
 	}
     //if its dead just return
 
-	new_view, err := pb.vs.Ping(pb.impl.view.Viewnum)
+    if time.Since(pb.impl.lastpingtime) > viewservice.PingInterval * viewservice.DeadPings {
+        pb.abandon()
+    }
+    //we may have been replaced, nothing held back can count on committing
+
+    viewnum := pb.impl.view.Viewnum
+    if !pb.allSynced() {
+        viewnum = pb.impl.acked
+    }
+    //hold off acking a view until the servers downstream of us have our state
+
+    sent := time.Now()
+	new_view, lease, err := pb.vs.PingLease(viewnum, pb.impl.recovered)
 
     if err != nil {
         return
     }
     //if error, return
+    pb.impl.lease = time.Time{}
+    if lease {
+        pb.impl.lease = sent.Add(viewservice.LeaseDuration)
+    }
+    //the lease counts from before the viewservice could have granted it
+    if time.Since(pb.impl.lastpingtime) > viewservice.PingInterval * viewservice.DeadPings {
+        pb.impl.fed_by = ""
+    }
+    //we may have been dropped from the view and missed writes since
     pb.impl.lastpingtime = time.Now()
+    pb.impl.acked = viewnum
 
-    var old_view viewservice.View
     if new_view.Viewnum != pb.impl.view.Viewnum {
-        old_view = pb.impl.view
+        was_primary, up := pb.me == pb.impl.view.Primary, pb.upstream()
         pb.impl.view = new_view
+        if (was_primary && pb.me != new_view.Primary) || up != pb.upstream() {
+            pb.abandon()
+        }
+        //whoever our replies were for is not counting on us anymore
+        if pb.me == new_view.Primary {
+            pb.impl.recovered = 0
+            pb.impl.stateview = new_view.Viewnum
+            pb.impl.wal.appendEntry(walEntry{Kind: entryView, Viewnum: new_view.Viewnum})
+        }
+        //remember the views we were primary in, that is what a restart reports
+        if pb.me != new_view.Primary && !new_view.IsBackup(pb.me) {
+            pb.impl.fed_by = ""
+        }
     }
 
     if pb.me == pb.impl.view.Primary {
-        if pb.impl.view.Backup != "" && pb.impl.view.Backup != old_view.Backup {
-			// make a copy of kv
-			kvCopy := make(map[string]string)
-			for k, v := range pb.impl.kv {
-				kvCopy[k] = v
-			}
-			
-			// copy EVERY cached result
-			opCache := make(map[string]Result)
-			for client, clientResults := range pb.impl.results {
-				for seq, result := range clientResults {
-					// make unique key for each client+seq combination
-					key := client + "-" + strconv.Itoa(seq)
-					opCache[key] = Result{SeqNo: seq, V: result}
-				}
-			}
-			
-			args := PushArgs{
-				KVStore: kvCopy,
-				OpCache: opCache,
-				View:    pb.impl.view,
-			}
-            
-			var reply PushReply
-			call(pb.impl.view.Backup, "PBServer.Push", &args, &reply) //if still alive
-        }
+        pb.expireDue()
+        pb.heartbeat()
+        pb.reconfigure()
     }
-}
\ No newline at end of file
+    pb.checkTransfer()
+    pb.advance()
+    pb.checkWatchers()
+    pb.probeSuccessor()
+    pb.sweepClients()
+    pb.impl.kv.sweep()
+}
@@ -0,0 +1,366 @@
+package pbservice
+
+import (
+	"time"
+
+	"umich.edu/eecs491/proj2/shardctrl"
+	"umich.edu/eecs491/proj2/viewservice"
+)
+
+//
+// Sharding.
+//
+// A server started with Options.Ctrl is one replica of group GID,
+// which serves the shards that the shard controller's current
+// config gives it (see shardctrl). Requests for keys in any other
+// shard get ErrWrongGroup.
+//
+// The primary polls the controller and moves through the configs
+// one at a time, each as an entryConfig in the log, so the backups
+// follow along. Applying a config:
+//
+//   - a shard that was nobody's is ours straight away;
+//   - a shard that was another group's waits for its data;
+//   - a shard of ours that now belongs to another group is no
+//     longer served, and leaves once the primary has handed its
+//     data over.
+//
+// Handing a shard over is a single Shard RPC from our primary to
+// the new group's primary, retried until it is acknowledged; it
+// carries the shard's keys and our cache of results, so a client
+// retrying against the new group is not applied twice. The new
+// primary puts the shard in its own log as an entryShardIn and
+// acks once that commits; then ours logs an entryShardOut and drops
+// the data. Only once no shard is waiting or leaving does the
+// primary go on to the next config.
+//
+
+// what a server is doing with a shard, in its current config
+const (
+	shardGone    = iota // not ours
+	shardServing        // ours
+	shardWaiting        // ours, but the data is still with the old group
+	shardLeaving        // no longer ours, and not handed over yet
+)
+
+type shardReq struct {
+	args  ShardArgs
+	reply *ShardReply
+	done  chan bool
+}
+
+// a config the controller gave us (see pollConfig)
+type configMsg struct {
+	config shardctrl.Config
+	ok     bool // false if the controller did not answer, or has no such config yet
+	done   chan bool
+}
+
+// a handover finished (see handOver)
+type handedMsg struct {
+	num   int
+	shard int
+	done  chan bool
+}
+
+// do we serve key right now?
+func (pb *PBServer) owns(key string) bool {
+	if pb.impl.ctrl == nil {
+		return true
+	}
+	return pb.impl.shards[shardctrl.Key2Shard(key)] == shardServing
+}
+
+// pairs without the keys we do not serve
+func (pb *PBServer) ownedOnly(pairs []KeyValue) []KeyValue {
+	if pb.impl.ctrl == nil {
+		return pairs
+	}
+	var kept []KeyValue
+	for _, kv := range pairs {
+		if pb.owns(kv.Key) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// every key a transaction touches
+func txnKeys(args *TxnArgs) []string {
+	keys := append([]string{}, args.Reads...)
+	for _, c := range args.Conds {
+		keys = append(keys, c.Key)
+	}
+	for _, w := range args.Writes {
+		keys = append(keys, w.Key)
+	}
+	return keys
+}
+
+// as primary, hand over the shards that left us, or else go on to the next config
+func (pb *PBServer) reconfigure() {
+	if pb.impl.ctrl == nil || pb.me != pb.impl.view.Primary {
+		return
+	}
+
+	settled := true
+	for s, state := range pb.impl.shards {
+		if state == shardWaiting {
+			settled = false
+		}
+		if state != shardLeaving {
+			continue
+		}
+		settled = false
+		if pb.impl.handing[s] || pb.impl.commit < pb.impl.conflsn {
+			continue
+		}
+		//the backups must know it left before anyone else serves it
+
+		gid := pb.impl.config.Shards[s]
+		pb.impl.handing[s] = true
+		go pb.handOver(pb.shardData(s), pb.impl.config.Groups[gid])
+	}
+	if !settled || pb.impl.polling {
+		return
+	}
+
+	pb.impl.polling = true
+	go pb.pollConfig(pb.impl.config.Num + 1)
+	//the controller may be slow to answer, or not answer at all
+}
+
+// runs in its own goroutine: ask the controller for config num, and tell run_channels
+func (pb *PBServer) pollConfig(num int) {
+	next, ok := pb.impl.ctrl.TryQuery(num)
+	msg := &configMsg{config: next, ok: ok && next.Num == num, done: make(chan bool)}
+	pb.impl.config_chan <- msg
+	<-msg.done
+}
+
+// runs in run_channels: go on to the next config, if we still may
+func (pb *PBServer) configImpl(msg *configMsg) {
+	pb.impl.polling = false
+	if !msg.ok || pb.isdead() || pb.me != pb.impl.view.Primary ||
+		msg.config.Num != pb.impl.config.Num+1 {
+		return
+	}
+	for _, state := range pb.impl.shards {
+		if state == shardWaiting || state == shardLeaving {
+			return
+		}
+	}
+	pb.submit(ReplicateArgs{Kind: entryConfig, Config: msg.config})
+}
+
+// a copy of shard s as it stands, with our cache of results
+func (pb *PBServer) shardData(s int) ShardArgs {
+	args := ShardArgs{
+		Num:      pb.impl.config.Num,
+		Shard:    s,
+		Expires:  make(map[string]time.Duration),
+		Versions: make(map[string][]version),
+		Source:   pb.me,
+	}
+	now := time.Now()
+	for _, kv := range pb.impl.kv.scan("", "", pb.impl.kv.size()) {
+		if shardctrl.Key2Shard(kv.Key) != s {
+			continue
+		}
+		args.KVStore = append(args.KVStore, kv)
+		deadline, ok := pb.impl.expires[kv.Key]
+		if ok {
+			args.Expires[kv.Key] = deadline.Sub(now)
+		}
+	}
+	for key, vs := range pb.impl.kv.versions() {
+		if shardctrl.Key2Shard(key) == s {
+			args.Versions[key] = vs
+		}
+	}
+	for client, cr := range pb.impl.results {
+		args.OpCache = append(args.OpCache, makeResult(client, cr))
+	}
+	return args
+}
+
+// runs in its own goroutine: send a shard to the primary of the group at vshost
+func (pb *PBServer) handOver(args ShardArgs, vshost string) {
+	vck := viewservice.MakeClerkWithCreds(pb.me, vshost, pb.creds)
+	for !pb.isdead() {
+		view, ok := vck.Get()
+		if ok && view.Primary != "" {
+			var reply ShardReply
+			if callCreds(pb.creds, view.Primary, "PBServer.Shard", &args, &reply) && reply.Err == OK {
+				break
+			}
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	msg := &handedMsg{num: args.Num, shard: args.Shard, done: make(chan bool)}
+	pb.impl.handed_chan <- msg
+	<-msg.done
+}
+
+// runs in run_channels: the shard is with its new owner, drop it
+func (pb *PBServer) handedImpl(msg *handedMsg) {
+	delete(pb.impl.handing, msg.shard)
+	if pb.isdead() || pb.me != pb.impl.view.Primary || msg.num != pb.impl.config.Num ||
+		pb.impl.shards[msg.shard] != shardLeaving {
+		return
+	}
+	pb.submit(ReplicateArgs{Kind: entryShardOut, Shard: ShardArgs{Num: msg.num, Shard: msg.shard}})
+}
+
+// Shard() sends the req through the channel, like Operation()
+func (pb *PBServer) Shard(args ShardArgs, reply *ShardReply) error {
+	if !pb.fromOwner(&args) {
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	req := &shardReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+	}
+	pb.impl.shard_chan <- req
+	<-req.done
+	return nil
+}
+
+//
+// did args come from a server of the group that had the shard
+// before config args.Num? asks the controller and that group's
+// viewservice, so not in run_channels.
+//
+func (pb *PBServer) fromOwner(args *ShardArgs) bool {
+	if pb.impl.ctrl == nil || args.Num < 1 || args.Shard < 0 || args.Shard >= shardctrl.NShards {
+		return false
+	}
+	prev, ok := pb.impl.ctrl.TryQuery(args.Num - 1)
+	if !ok || prev.Num != args.Num-1 {
+		return false
+	}
+	vshost, ok := prev.Groups[prev.Shards[args.Shard]]
+	if !ok {
+		return false
+	}
+	view, ok := viewservice.MakeClerkWithCreds(pb.me, vshost, pb.creds).Get()
+	return ok && (view.Primary == args.Source || view.IsBackup(args.Source))
+	//the sender may have failed over since it sent, but is still in the group
+}
+
+//
+// what shard() does (runs in run_channels goroutine). returns the
+// LSN that has to commit before the reply goes out, like operationImpl.
+//
+func (pb *PBServer) shardImpl(args *ShardArgs, reply *ShardReply) int64 {
+	if pb.impl.ctrl == nil || !pb.admit(false) {
+		reply.Err = ErrWrongServer
+		return 0
+	}
+	if args.Num > pb.impl.config.Num {
+		reply.Err = ErrWrongGroup
+		return 0
+	}
+	//we are not in that config yet, the sender tries again later
+
+	reply.Err = OK
+	if args.Num < pb.impl.config.Num || pb.impl.shards[args.Shard] != shardWaiting {
+		return pb.impl.lsn
+	}
+	//we already have it, once that commits
+
+	lsn, ok := pb.submit(ReplicateArgs{Kind: entryShardIn, Shard: *args})
+	if !ok {
+		reply.Err = ErrWrongServer
+		return 0
+	}
+	return lsn
+}
+
+// log a shard entry and then apply it, like commitOp()
+func (pb *PBServer) commitShard(e walEntry) bool {
+	if e.Kind == entryShardIn {
+		now := time.Now()
+		e.Expires = make(map[string]time.Time)
+		for key, ttl := range e.Shard.Expires {
+			e.Expires[key] = now.Add(ttl)
+		}
+	}
+	err := pb.impl.wal.appendEntry(e)
+	if err != nil {
+		return false
+	}
+	pb.applyShard(&e)
+	pb.compact()
+	return true
+}
+
+// apply a shard entry (also used for wal replay)
+func (pb *PBServer) applyShard(e *walEntry) {
+	switch e.Kind {
+	case entryConfig:
+		if e.Config.Num != pb.impl.config.Num+1 {
+			return
+		}
+		for s := range pb.impl.shards {
+			old, next := pb.impl.config.Shards[s], e.Config.Shards[s]
+			switch {
+			case old == next:
+			case next == pb.impl.gid && old == 0:
+				pb.impl.shards[s] = shardServing
+			case next == pb.impl.gid:
+				pb.impl.shards[s] = shardWaiting
+			case old == pb.impl.gid && next == 0:
+				pb.dropShard(s)
+				//nobody to hand it to
+			case old == pb.impl.gid:
+				pb.impl.shards[s] = shardLeaving
+			}
+		}
+		pb.impl.config = e.Config
+		pb.impl.conflsn = pb.impl.lsn
+
+	case entryShardIn:
+		s := e.Shard.Shard
+		if e.Shard.Num != pb.impl.config.Num || pb.impl.shards[s] != shardWaiting {
+			return
+		}
+		for _, kv := range e.Shard.KVStore {
+			pb.impl.kv.load(kv.Key, kv.Value, kv.Rev)
+			pb.setDeadline(kv.Key, e.Expires[kv.Key])
+		}
+		for key, vs := range e.Shard.Versions {
+			pb.impl.kv.restore(key, vs)
+		}
+		//our revisions carry on from past the shard's
+		for _, r := range e.Shard.OpCache {
+			pb.mergeResults(pb.impl.results, r)
+		}
+		//the client may have been talking to both groups
+		pb.impl.shards[s] = shardServing
+
+	case entryShardOut:
+		s := e.Shard.Shard
+		if e.Shard.Num == pb.impl.config.Num && pb.impl.shards[s] == shardLeaving {
+			pb.dropShard(s)
+		}
+	}
+}
+
+// forget every key in shard s
+func (pb *PBServer) dropShard(s int) {
+	for _, kv := range pb.impl.kv.scan("", "", pb.impl.kv.size()) {
+		if shardctrl.Key2Shard(kv.Key) == s {
+			pb.impl.kv.drop(kv.Key)
+			pb.setDeadline(kv.Key, time.Time{})
+		}
+	}
+	for _, key := range pb.impl.kv.deleted() {
+		if shardctrl.Key2Shard(key) == s {
+			pb.impl.kv.drop(key)
+		}
+	}
+	pb.impl.shards[s] = shardGone
+}
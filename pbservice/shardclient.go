@@ -0,0 +1,100 @@
+package pbservice
+
+import (
+	"context"
+	"time"
+
+	"umich.edu/eecs491/proj2/shardctrl"
+	"umich.edu/eecs491/proj2/viewservice"
+)
+
+//
+// A client of a sharded key space (see shard.go). It sends each
+// operation to the replica group that serves the key's shard in the
+// latest config it knows of, and on ErrWrongGroup fetches the config
+// again and retries.
+//
+// The groups see a single client: one name and one sequence of
+// SeqNos, which a shard's cache of results carries along when it
+// moves, so an operation retried at the shard's new group is not
+// applied twice.
+//
+// how long to wait on a group before checking the config again
+const groupWait = 2 * viewservice.DeadPings * viewservice.PingInterval
+
+type ShardClerk struct {
+	me     string
+	seqno  int
+	ctrl   *shardctrl.Clerk
+	config shardctrl.Config
+	groups map[int64]*Clerk // a Clerk for each group, all with our name
+}
+
+func MakeShardClerk(ctrlhost string) *ShardClerk {
+	nameInitialize()
+
+	sc := new(ShardClerk)
+	sc.me = <-nameChan
+	sc.ctrl = shardctrl.MakeClerk(ctrlhost)
+	sc.groups = make(map[int64]*Clerk)
+	return sc
+}
+
+//
+// perform an operation at the group serving key, until one
+// answers with something other than ErrWrongGroup
+//
+func (sc *ShardClerk) doOperation(op Op, key string, value string, reply *OpReply) {
+	sc.seqno = sc.seqno + 1
+	args := OpArgs{Op: op, Key: key, Value: value,
+		Client: sc.me, SeqNo: sc.seqno, Acked: sc.seqno - 1, Source: sc.me}
+	for {
+		gid := sc.config.Shards[shardctrl.Key2Shard(key)]
+		vshost, ok := sc.config.Groups[gid]
+		if gid != 0 && ok {
+			ck, ok := sc.groups[gid]
+			if !ok {
+				ck = MakeClerk(vshost, sc.me)
+				sc.groups[gid] = ck
+			}
+			*reply = OpReply{}
+			ctx, cancel := context.WithTimeout(context.Background(), groupWait)
+			err := ck.send(ctx, args, reply)
+			cancel()
+			//the same SeqNo every time round, so a retry is recognized
+			if err == nil && reply.Err != ErrWrongGroup {
+				return
+			}
+			//a group that does not answer may have left, and handed the shard on
+		}
+
+		time.Sleep(viewservice.PingInterval)
+		sc.config = sc.ctrl.Query(-1)
+	}
+}
+
+//
+// Get a value for a key, "" if there is none
+//
+func (sc *ShardClerk) Get(key string) string {
+	var reply OpReply
+	sc.doOperation(GET, key, "", &reply)
+	return reply.Value
+}
+
+func (sc *ShardClerk) Put(key string, value string) {
+	var reply OpReply
+	sc.doOperation(PUT, key, value, &reply)
+}
+
+func (sc *ShardClerk) Append(key string, value string) {
+	var reply OpReply
+	sc.doOperation(APPEND, key, value, &reply)
+}
+
+// returns whether the key existed beforehand
+func (sc *ShardClerk) Delete(key string) bool {
+	var reply OpReply
+	sc.doOperation(DELETE, key, "", &reply)
+	return reply.Err == OK
+}
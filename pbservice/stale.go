@@ -0,0 +1,53 @@
+package pbservice
+
+import (
+	"time"
+)
+
+//
+// Stale reads from a backup.
+//
+// A Get with MaxStale set may be answered by a backup instead of
+// the primary, from whatever state the backup has. Every entry the
+// primary logs carries the time it did so (ReplicateArgs.Stamp),
+// and the primary sends a no-op down the pipeline every tick even
+// when nothing else is happening, so a backup knows how recent its
+// state is: it reflects everything the primary had applied as of
+// the stamp of the last entry it applied. It answers if that is
+// within MaxStale and it has at least the entry MinLSN, and says in
+// the reply which view and log entry the answer reflects.
+//
+// Stamps come from the primary's clock and are judged by the
+// backup's, so the bound is only as good as their agreement.
+//
+
+// as primary, keep the backups' stamps fresh
+func (pb *PBServer) heartbeat() {
+	if len(pb.downstream()) > 0 {
+		pb.submit(ReplicateArgs{Kind: entryNop})
+	}
+}
+
+// as backup, answer a Get from our own state if it is recent enough
+func (pb *PBServer) staleGet(args *OpArgs, reply *OpReply) {
+	if pb.isdead() || !pb.impl.view.IsBackup(pb.me) ||
+		pb.impl.fed_by == "" || pb.impl.fed_by != pb.upstream() {
+		reply.Err = ErrWrongServer
+		return
+	}
+	//we may not have the primary's state at all
+
+	if !pb.owns(args.Key) {
+		reply.Err = ErrWrongGroup
+		return
+	}
+
+	if time.Since(pb.impl.stamp) > args.MaxStale || pb.impl.lsn < args.MinLSN {
+		reply.Err = ErrStale
+		return
+	}
+
+	*reply = pb.readKey(args)
+	reply.Viewnum = pb.impl.view.Viewnum
+	reply.LSN = pb.impl.lsn
+}
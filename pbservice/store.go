@@ -0,0 +1,365 @@
+package pbservice
+
+import (
+	"math/rand"
+	"time"
+)
+
+//
+// The key/value store: a map for lookups, plus a skiplist that
+// keeps the same keys in sorted order so ranges can be scanned
+// without sorting the whole key space each time.
+//
+// Every write (a put, or a del of a key that exists) moves the
+// store on to the next revision, and each key carries the revision
+// of its latest write. Every server applies the same writes in the
+// same order, so they agree on the revisions.
+//
+// If asked to (see retain), the store also keeps the values each
+// key had before, so it can be read as of an earlier revision (see
+// at): up to keep of them per key, and none that was replaced more
+// than keepFor ago. A deleted key's versions are kept only if there
+// is an age limit, and for no longer than that.
+//
+
+const maxLevel = 24
+
+// a value a key had
+type version struct {
+	Rev      int64     // the write that gave the key this value
+	Value    string
+	Deleted  bool      // the write deleted the key
+	Replaced time.Time // when the next write came (for a delete, when it was)
+}
+
+type node struct {
+	key     string
+	value   string
+	rev     int64     // revision of the latest write
+	history []version // earlier values, oldest first
+	next    []*node   // next[i] is the following node at level i
+}
+
+type store struct {
+	head      *node // sentinel, holds no key
+	level     int   // levels in use
+	nodes     map[string]*node
+	rnd       *rand.Rand
+	rev       int64                // revision of the latest write
+	keep      int                  // earlier values to keep per key
+	keepFor   time.Duration        // and for how long, 0 for no limit
+	gone      map[string][]version // versions of deleted keys, ending with the delete
+	forgot    int64                // as of earlier revisions, a key we know nothing of may have existed
+	lastsweep time.Time            // when we last looked for old deleted keys
+}
+
+func newStore() *store {
+	return &store{
+		head:  &node{next: make([]*node, maxLevel)},
+		level: 1,
+		nodes: make(map[string]*node),
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+		gone:  make(map[string][]version),
+	}
+}
+
+// keep up to n earlier values per key, for no longer than d (0 for no limit)
+func (st *store) retain(n int, d time.Duration) {
+	st.keep = n
+	st.keepFor = d
+}
+
+func (st *store) get(key string) (string, bool) {
+	n, ok := st.nodes[key]
+	if !ok {
+		return "", false
+	}
+	return n.value, true
+}
+
+// get, along with the revision of the key's latest write
+func (st *store) lookup(key string) (string, int64, bool) {
+	n, ok := st.nodes[key]
+	if !ok {
+		return "", 0, false
+	}
+	return n.value, n.rev, true
+}
+
+//
+// the value key had as of revision rev, and the revision of the
+// write that gave it that value. false if the key did not exist
+// then. ErrCompacted if we no longer know, ErrNoRev if the store
+// has not got to rev yet.
+//
+func (st *store) at(key string, rev int64) (string, int64, bool, Err) {
+	if rev > st.rev {
+		return "", 0, false, ErrNoRev
+	}
+	history := st.gone[key]
+	n, ok := st.nodes[key]
+	if ok {
+		if n.rev <= rev {
+			return n.value, n.rev, true, OK
+		}
+		history = n.history
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		v := history[i]
+		if v.Rev <= rev {
+			return v.Value, v.Rev, !v.Deleted, OK
+		}
+	}
+	if !ok && history == nil && rev >= st.forgot {
+		return "", 0, false, OK
+	}
+	//any delete of it we did not keep came before forgot
+	return "", 0, false, ErrCompacted
+}
+
+func (st *store) size() int {
+	return len(st.nodes)
+}
+
+// the last node at each level with a key < key
+func (st *store) predecessors(key string) []*node {
+	prev := make([]*node, maxLevel)
+	x := st.head
+	for i := st.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		prev[i] = x
+	}
+	return prev
+}
+
+func (st *store) randomLevel() int {
+	level := 1
+	for level < maxLevel && st.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// write value to key
+func (st *store) put(key string, value string) {
+	st.rev++
+	now := time.Now()
+	if n, ok := st.nodes[key]; ok {
+		if st.keep > 0 {
+			n.history = st.trim(append(n.history, version{Rev: n.rev, Value: n.value, Replaced: now}), st.keep, now)
+		}
+		n.value, n.rev = value, st.rev
+		return
+	}
+
+	n := st.insert(key, value, st.rev)
+	if past, ok := st.gone[key]; ok {
+		delete(st.gone, key)
+		n.history = st.trim(past, st.keep, now)
+	} else if st.keep > 0 {
+		n.history = []version{{Rev: st.forgot, Deleted: true, Replaced: now}}
+	}
+	//the key was deleted and is back, it has the same past; or it
+	//did not exist as of any revision we would know of a delete from
+}
+
+//
+// set key to value, with the revision rev it got it at somewhere
+// else (a snapshot, the primary, the group that had its shard).
+// not a write: the store's revision only moves up to rev.
+//
+func (st *store) load(key string, value string, rev int64) {
+	if rev > st.rev {
+		st.rev = rev
+	}
+	if n, ok := st.nodes[key]; ok {
+		n.value, n.rev = value, rev
+		return
+	}
+	st.insert(key, value, rev)
+}
+
+// set the earlier versions of key, deleted or not, as loaded from somewhere else
+func (st *store) restore(key string, history []version) {
+	if n, ok := st.nodes[key]; ok {
+		n.history = history
+	} else if len(history) > 0 {
+		st.gone[key] = history
+	}
+}
+
+// add a node for a key that is not in the store
+func (st *store) insert(key string, value string, rev int64) *node {
+	prev := st.predecessors(key)
+	level := st.randomLevel()
+	if level > st.level {
+		for i := st.level; i < level; i++ {
+			prev[i] = st.head
+		}
+		st.level = level
+	}
+
+	n := &node{key: key, value: value, rev: rev, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	st.nodes[key] = n
+	return n
+}
+
+// delete key, if it exists
+func (st *store) del(key string) {
+	n, ok := st.nodes[key]
+	if !ok {
+		return
+	}
+	st.rev++
+	st.unlink(n)
+	if st.keep > 0 && st.keepFor > 0 {
+		now := time.Now()
+		past := append(n.history, version{Rev: n.rev, Value: n.value, Replaced: now},
+			version{Rev: st.rev, Deleted: true, Replaced: now})
+		st.gone[key] = st.trim(past, st.keep+1, now)
+		return
+	}
+	st.forgot = st.rev
+}
+
+// forget key and its past altogether, without a write (its shard left us)
+func (st *store) drop(key string) {
+	delete(st.gone, key)
+	if n, ok := st.nodes[key]; ok {
+		st.unlink(n)
+	}
+}
+
+// the deleted keys whose versions we still have
+func (st *store) deleted() []string {
+	keys := make([]string, 0, len(st.gone))
+	for key := range st.gone {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// take n out of the skiplist and the map
+func (st *store) unlink(n *node) {
+	key := n.key
+	prev := st.predecessors(key)
+	for i := 0; i < len(n.next); i++ {
+		if prev[i].next[i] == n {
+			prev[i].next[i] = n.next[i]
+		}
+	}
+	delete(st.nodes, key)
+	for st.level > 1 && st.head.next[st.level-1] == nil {
+		st.level--
+	}
+}
+
+//
+// up to limit pairs with start <= key < end, in key order.
+// an empty end means no upper bound.
+//
+func (st *store) scan(start string, end string, limit int) []KeyValue {
+	var pairs []KeyValue
+	x := st.predecessors(start)[0].next[0]
+	for x != nil && len(pairs) < limit {
+		if end != "" && x.key >= end {
+			break
+		}
+		pairs = append(pairs, KeyValue{Key: x.key, Value: x.value, Rev: x.rev})
+		x = x.next[0]
+	}
+	return pairs
+}
+
+// a plain copy of the contents, for Push and snapshots
+func (st *store) toMap() map[string]string {
+	m := make(map[string]string, len(st.nodes))
+	for k, n := range st.nodes {
+		m[k] = n.value
+	}
+	return m
+}
+
+// the revision of each key, to go with toMap
+func (st *store) revs() map[string]int64 {
+	m := make(map[string]int64, len(st.nodes))
+	for k, n := range st.nodes {
+		m[k] = n.rev
+	}
+	return m
+}
+
+// the earlier versions of every key that has some, deleted keys included
+func (st *store) versions() map[string][]version {
+	m := make(map[string][]version)
+	for k, n := range st.nodes {
+		if len(n.history) > 0 {
+			m[k] = n.history
+		}
+	}
+	for k, vs := range st.gone {
+		m[k] = vs
+	}
+	return m
+}
+
+// a store holding what toMap, revs and versions returned
+func storeFrom(m map[string]string, revs map[string]int64,
+	versions map[string][]version) *store {
+	st := newStore()
+	for k, v := range m {
+		st.load(k, v, revs[k])
+	}
+	for k, vs := range versions {
+		st.restore(k, vs)
+	}
+	return st
+}
+
+// the store is at revision rev, and forgot the deletes before forgot, somewhere else
+func (st *store) setRev(rev int64, forgot int64) {
+	if rev > st.rev {
+		st.rev = rev
+	}
+	st.forgot = forgot
+}
+
+//
+// the last n of vs (oldest first), leaving out any replaced more
+// than keepFor before now
+//
+func (st *store) trim(vs []version, n int, now time.Time) []version {
+	if len(vs) > n {
+		vs = vs[len(vs)-n:]
+	}
+	for st.keepFor > 0 && len(vs) > 0 && now.Sub(vs[0].Replaced) > st.keepFor {
+		vs = vs[1:]
+	}
+	if len(vs) == 0 {
+		return nil
+	}
+	return vs
+}
+
+// forget the deleted keys whose delete is older than keepFor
+func (st *store) sweep() {
+	if len(st.gone) == 0 || time.Since(st.lastsweep) < st.keepFor/10 {
+		return
+	}
+	st.lastsweep = time.Now()
+	for key, vs := range st.gone {
+		last := vs[len(vs)-1]
+		if time.Since(last.Replaced) > st.keepFor {
+			delete(st.gone, key)
+			if last.Rev > st.forgot {
+				st.forgot = last.Rev
+			}
+		}
+	}
+}
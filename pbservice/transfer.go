@@ -0,0 +1,288 @@
+package pbservice
+
+import (
+	"time"
+
+	"umich.edu/eecs491/proj2/shardctrl"
+	"umich.edu/eecs491/proj2/viewservice"
+)
+
+//
+// State transfer to a new backup.
+//
+// (In a chain, read "each server" for the primary and "its
+// successor" for the backup, see chain.go.)
+//
+// When a backup shows up, the primary freezes a copy of its state
+// (the keys in order, then the cached results) under a fresh
+// version number, and the backup's stream (see pipeline.go) sends
+// it over in pages of pushPage items before any log entries. The
+// backup collects the pages off to the side and only switches over
+// to them once the last one is in. Every reply says which page the
+// backup wants next, so a lost page or a lost reply just means
+// sending that page again.
+//
+// The primary keeps serving clients during the transfer. Mutations
+// made since the snapshot pile up in the stream, and follow the
+// snapshot once it is in; the backup counts as synced from then on.
+//
+// Each backup of the view gets its own stream. The primary does not
+// ack a view to the viewservice until all of its backups are synced
+// and have every entry it answered for, so a half-filled backup is
+// never promoted.
+//
+
+const pushPage = 1000
+
+// a frozen copy of our state, on its way downstream
+type transfer struct {
+	backup  string
+	source  string // us
+	view    viewservice.View
+	version int64
+	lsn     int64 // the last entry applied before the copy
+	pairs   []KeyValue
+	cache   []Result
+	expires map[string]time.Time
+	config  shardctrl.Config
+	shards  [shardctrl.NShards]int
+	history map[string][]version // earlier values of the keys in pairs
+	gone    map[string][]version // and of deleted keys
+	rev     int64                // the store's revision (see store.go)
+	forgot  int64
+}
+
+// an incoming transfer, owned by the backup
+type incoming struct {
+	version int64
+	next    int // offset of the next page we need
+	kv      *store
+	results map[string]clientResult
+	expires map[string]time.Time
+}
+
+// freeze our state, to send to backup
+func (pb *PBServer) freeze(backup string) *transfer {
+	t := &transfer{
+		backup:  backup,
+		source:  pb.me,
+		view:    pb.impl.view,
+		version: time.Now().UnixNano(),
+		lsn:     pb.impl.lsn,
+		pairs:   pb.impl.kv.scan("", "", pb.impl.kv.size()),
+		expires: make(map[string]time.Time),
+		config:  pb.impl.config,
+		shards:  pb.impl.shards,
+		history: make(map[string][]version),
+		gone:    make(map[string][]version),
+		rev:     pb.impl.kv.rev,
+		forgot:  pb.impl.kv.forgot,
+	}
+	for key, vs := range pb.impl.kv.versions() {
+		if _, ok := pb.impl.kv.get(key); ok {
+			t.history[key] = vs
+		} else {
+			t.gone[key] = vs
+		}
+	}
+	for client, cr := range pb.impl.results {
+		t.cache = append(t.cache, makeResult(client, cr))
+	}
+	for key, deadline := range pb.impl.expires {
+		t.expires[key] = deadline
+	}
+	return t
+}
+
+// the page of t's snapshot starting at offset
+func (t *transfer) page(offset int) PushArgs {
+	total := len(t.pairs) + len(t.cache)
+	end := offset + pushPage
+	if end > total {
+		end = total
+	}
+	args := PushArgs{
+		View:    t.view,
+		Source:  t.source,
+		Version: t.version,
+		LSN:     t.lsn,
+		Offset:  offset,
+		Expires: make(map[string]time.Duration),
+		Last:    end == total,
+		Config:  t.config,
+		Shards:  t.shards,
+		Versions: make(map[string][]version),
+		Rev:     t.rev,
+		Forgot:  t.forgot,
+	}
+	now := time.Now()
+	for i := offset; i < end; i++ {
+		if i < len(t.pairs) {
+			kv := t.pairs[i]
+			args.KVStore = append(args.KVStore, kv)
+			deadline, ok := t.expires[kv.Key]
+			if ok {
+				args.Expires[kv.Key] = deadline.Sub(now)
+			}
+			vs, ok := t.history[kv.Key]
+			if ok {
+				args.Versions[kv.Key] = vs
+			}
+		} else {
+			args.OpCache = append(args.OpCache, t.cache[i-len(t.pairs)])
+		}
+	}
+	if args.Last {
+		for key, vs := range t.gone {
+			args.Versions[key] = vs
+		}
+	}
+	return args
+}
+
+// send s's snapshot, page by page. false if s was closed first
+func (pb *PBServer) sendState(s *stream) bool {
+	t := s.snap
+	total := len(t.pairs) + len(t.cache)
+	next := 0
+	for !pb.isdead() && !s.isClosed() {
+		args := t.page(next)
+		var reply PushReply
+		ok := callCreds(pb.creds, t.backup, "PBServer.Push", &args, &reply)
+		if ok && reply.Err == OK {
+			if reply.Next >= total {
+				return true
+			}
+			next = reply.Next
+			continue
+		}
+		//the backup may not know about its view yet, try again in a bit
+
+		time.Sleep(viewservice.PingInterval)
+	}
+	return false
+}
+
+// keep a stream going to each server downstream of us
+func (pb *PBServer) checkTransfer() {
+	down := make(map[string]bool)
+	for _, backup := range pb.downstream() {
+		down[backup] = true
+	}
+	for backup, s := range pb.impl.streams {
+		if !down[backup] {
+			s.close()
+			delete(pb.impl.streams, backup)
+		}
+	}
+	for backup := range down {
+		if pb.impl.streams[backup] == nil {
+			pb.startStream(backup)
+		}
+	}
+}
+
+// do all the servers downstream of us have our state, up to what we answered for?
+func (pb *PBServer) allSynced() bool {
+	for _, backup := range pb.downstream() {
+		s := pb.impl.streams[backup]
+		if s == nil || !s.synced || s.acked < pb.impl.commit {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// as backup, take in a page of the primary's state. the pages
+// of a new version start over; a page we already have only gets
+// the offset we need next in reply.
+//
+func (pb *PBServer) receivePage(args *PushArgs, reply *PushReply) {
+	next, last := pb.collect(&pb.impl.receiving, args)
+	if last {
+		pb.switchTo(pb.impl.receiving, args)
+		pb.impl.config = args.Config
+		pb.impl.shards = args.Shards
+		pb.impl.conflsn = args.LSN
+		pb.impl.view = args.View
+		pb.impl.fed_by = args.Source
+		pb.impl.recovered = 0
+		pb.impl.stateview = args.View.Viewnum
+		pb.abandon()
+		pb.impl.lsn = args.LSN
+		pb.impl.commit = args.LSN
+		pb.resetChanges(pb.impl.kv.rev)
+		pb.restartStreams()
+		//we carry on from the sender's log, and our own successor needs the new state
+		pb.saveSnapshot()
+		//the pushed state replaces whatever we recovered, on disk too
+	}
+	reply.Err = OK
+	reply.Next = next
+}
+
+//
+// add a page of a snapshot to the one coming in at *in, starting
+// over for a new version. returns the offset of the page we need
+// next, and whether this page completed the snapshot.
+//
+func (pb *PBServer) collect(into **incoming, args *PushArgs) (int, bool) {
+	in := *into
+	if in == nil || in.version != args.Version {
+		if args.Offset != 0 {
+			return 0, false
+		}
+		in = &incoming{
+			version: args.Version,
+			kv:      newStore(),
+			results: make(map[string]clientResult),
+			expires: make(map[string]time.Time),
+		}
+		*into = in
+	}
+	if args.Offset != in.next || in.kv == nil {
+		return in.next, false
+	}
+
+	now := time.Now()
+	for _, kv := range args.KVStore {
+		in.kv.load(kv.Key, kv.Value, kv.Rev)
+		ttl, ok := args.Expires[kv.Key]
+		if ok {
+			in.expires[kv.Key] = now.Add(ttl)
+		}
+	}
+	for key, vs := range args.Versions {
+		in.kv.restore(key, vs)
+	}
+	for _, r := range args.OpCache {
+		pb.mergeResults(in.results, r)
+	}
+	in.next += len(args.KVStore) + len(args.OpCache)
+	return in.next, args.Last
+}
+
+// replace our store and cache of results with the snapshot in, whose last page was args
+func (pb *PBServer) switchTo(in *incoming, args *PushArgs) {
+	in.kv.setRev(args.Rev, args.Forgot)
+	in.kv.retain(pb.impl.kv.keep, pb.impl.kv.keepFor)
+	pb.impl.kv = in.kv
+	pb.impl.results = in.results
+	pb.impl.expires = make(map[string]time.Time)
+	pb.impl.deadlines = nil
+	for key, deadline := range in.expires {
+		pb.setDeadline(key, deadline)
+	}
+	//keys whose deadline passed in the meantime expire on the next tick
+	in.kv, in.results, in.expires = nil, nil, nil
+	//keep version and next around to answer a resent last page
+}
+
+// close every stream, so each server downstream of us is sent our state afresh
+func (pb *PBServer) restartStreams() {
+	for backup, s := range pb.impl.streams {
+		s.close()
+		delete(pb.impl.streams, backup)
+	}
+}
@@ -0,0 +1,156 @@
+package pbservice
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Watches.
+//
+// Every server remembers the latest changes to its store (about
+// maxChanges of them), each tagged with the store revision it made
+// (see store.go) and the log entry it was in. Every server makes the
+// same changes in the same order, so a revision means the same thing
+// after a failover.
+//
+// A Watch RPC asks the primary for the changes to a key (or under a
+// prefix) after some revision. The primary answers with those whose
+// entries have committed, or if there are none yet, holds on to the
+// request until there are, or until watchPoll has passed. Either way
+// the reply says which revision it is complete through, and the
+// Clerk asks for what comes after that next, from whoever is primary
+// by then.
+//
+// The history starts over when a server restarts or gets a fresh
+// copy of the database (see transfer.go). Asking for revisions from
+// before that gets ErrCompacted.
+//
+
+const (
+	maxChanges = 10000       // changes each server remembers
+	maxWatch   = 1000        // most changes in a Watch reply
+	watchPoll  = time.Second // longest the primary holds on to a Watch
+)
+
+// remember a change made by the entry we are applying
+func (pb *PBServer) recordChange(op Op, key string, value string) {
+	pb.impl.changes = append(pb.impl.changes, Event{Op: op, Key: key, Value: value,
+		Viewnum: pb.impl.logview, Rev: pb.impl.kv.rev, LSN: pb.impl.lsn})
+	if len(pb.impl.changes) < maxChanges+maxChanges/10 {
+		return
+	}
+	//trim now and then, not on every change
+
+	drop := len(pb.impl.changes) - maxChanges
+	pb.impl.history = pb.impl.changes[drop-1].Rev
+	pb.impl.changes = append([]Event(nil), pb.impl.changes[drop:]...)
+}
+
+// forget every change, the store is at revision rev
+func (pb *PBServer) resetChanges(rev int64) {
+	pb.impl.changes = nil
+	pb.impl.history = rev
+}
+
+// Watch() sends the req through the channel, like Operation()
+func (pb *PBServer) Watch(args WatchArgs, reply *WatchReply) error {
+	req := &watchReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+		since: time.Now(),
+	}
+	pb.impl.watch_chan <- req
+	<-req.done
+	return nil
+}
+
+// what watch() does (runs in run_channels goroutine)
+func (pb *PBServer) watchImpl(req *watchReq) {
+	if !pb.admit(false) {
+		req.reply.Err = ErrWrongServer
+		req.done <- true
+		return
+	}
+	if req.args.Now {
+		req.args.After, req.args.Now = pb.committedRev(), false
+	}
+	if pb.watchReady(&req.args, req.reply) {
+		req.done <- true
+		return
+	}
+	pb.impl.watchers = append(pb.impl.watchers, req)
+}
+
+//
+// fill in the reply to a watch with the committed changes it is
+// after. true if that is worth sending: there are some, or we no
+// longer have them.
+//
+func (pb *PBServer) watchReady(args *WatchArgs, reply *WatchReply) bool {
+	reply.Viewnum = pb.impl.view.Viewnum
+	if args.After < pb.impl.history {
+		reply.Err = ErrCompacted
+		return true
+	}
+
+	reply.Err = OK
+	reply.Events = nil
+	reply.Rev = pb.committedRev()
+	changes := pb.impl.changes
+	i := sort.Search(len(changes), func(i int) bool { return changes[i].Rev > args.After })
+	for ; i < len(changes) && changes[i].LSN <= pb.impl.commit; i++ {
+		n := len(reply.Events)
+		if n >= maxWatch {
+			reply.Rev = reply.Events[n-1].Rev
+			break
+		}
+		if args.matches(changes[i].Key) {
+			reply.Events = append(reply.Events, changes[i])
+		}
+	}
+	if reply.Rev < args.After {
+		reply.Rev = args.After
+	}
+	//a new primary may not have committed as far as the old one yet
+	return len(reply.Events) > 0
+}
+
+// the store revision as of the last entry that committed
+func (pb *PBServer) committedRev() int64 {
+	changes := pb.impl.changes
+	i := sort.Search(len(changes), func(i int) bool { return changes[i].LSN > pb.impl.commit })
+	if i == 0 {
+		return pb.impl.history
+	}
+	return changes[i-1].Rev
+}
+
+// is key one the watch is for?
+func (args *WatchArgs) matches(key string) bool {
+	if args.Prefix {
+		return strings.HasPrefix(key, args.Key)
+	}
+	return key == args.Key
+}
+
+// answer the watches there is now something to tell, or that have waited long enough
+func (pb *PBServer) checkWatchers() {
+	kept := pb.impl.watchers[:0]
+	for _, req := range pb.impl.watchers {
+		switch {
+		case pb.isdead() || pb.me != pb.impl.view.Primary:
+			req.reply.Err = ErrWrongServer
+		case pb.watchReady(&req.args, req.reply):
+		case time.Since(req.since) > watchPoll:
+			//nothing yet, the reply says how far we looked
+		default:
+			kept = append(kept, req)
+			continue
+		}
+		req.done <- true
+	}
+	pb.impl.watchers = kept
+}
@@ -0,0 +1,100 @@
+package shardctrl
+
+import (
+	"time"
+
+	"umich.edu/eecs491/proj2/transport"
+)
+
+type Clerk struct {
+	server string
+}
+
+func MakeClerk(server string) *Clerk {
+	ck := new(Clerk)
+	ck.server = server
+	return ck
+}
+
+//
+// call() sends an RPC to the rpcname handler on server srv
+// with arguments args, waits for the reply, and leaves the
+// reply in reply. the reply argument should be a pointer
+// to a reply structure.
+//
+// the return value is true if the server responded, and false
+// if call() was not able to contact the server.
+//
+func call(srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	err := transport.Shared(nil).Call(srv, rpcname, args, reply)
+	return err == nil
+}
+
+// the RPCs below keep trying until the controller answers
+
+//
+// fetch config num, or the latest one if num is -1
+//
+func (ck *Clerk) Query(num int) Config {
+	for {
+		args := &QueryArgs{Num: num}
+		var reply QueryReply
+		if call(ck.server, "ShardCtrl.Query", args, &reply) {
+			return reply.Config
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//
+// like Query, but ask only once. false if the controller did not answer
+//
+func (ck *Clerk) TryQuery(num int) (Config, bool) {
+	args := &QueryArgs{Num: num}
+	var reply QueryReply
+	ok := call(ck.server, "ShardCtrl.Query", args, &reply)
+	return reply.Config, ok
+}
+
+//
+// add replica group gid, whose viewservice is at server
+//
+func (ck *Clerk) Join(gid int64, server string) {
+	for {
+		args := &JoinArgs{GID: gid, Server: server}
+		var reply JoinReply
+		if call(ck.server, "ShardCtrl.Join", args, &reply) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//
+// take replica group gid out, handing its shards to the others
+//
+func (ck *Clerk) Leave(gid int64) {
+	for {
+		args := &LeaveArgs{GID: gid}
+		var reply LeaveReply
+		if call(ck.server, "ShardCtrl.Leave", args, &reply) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//
+// hand shard to replica group gid. false if gid has not joined
+//
+func (ck *Clerk) Move(shard int, gid int64) bool {
+	for {
+		args := &MoveArgs{Shard: shard, GID: gid}
+		var reply MoveReply
+		if call(ck.server, "ShardCtrl.Move", args, &reply) {
+			return reply.Err == OK
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,82 @@
+package shardctrl
+
+import (
+	"hash/fnv"
+)
+
+//
+// Shard controller.
+//
+// The key space is split into NShards shards by a hash of the key,
+// and each shard is served by one replica group: a primary/backup
+// pair (or chain) managed by a viewservice of its own. The shard
+// controller keeps a numbered sequence of configurations, each of
+// which says which group serves each shard, and how to find each
+// group (the address of its viewservice).
+//
+// Groups Join and Leave; after each, the shards are spread out
+// evenly again, moving as few as possible. Move hands one shard to
+// a given group, e.g. to take load off a hot one. Query returns a
+// configuration; the groups poll it and move the data themselves
+// (see pbservice/shard.go).
+//
+// The first configuration (#0) has no groups, and every shard is
+// assigned to group 0, meaning none.
+//
+
+const NShards = 10
+
+type Config struct {
+	Num    int              // config number
+	Shards [NShards]int64   // group of each shard, 0 for none
+	Groups map[int64]string // group -> address of its viewservice
+}
+
+// which shard key belongs to
+func Key2Shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % NShards)
+}
+
+// Error values
+type Err string
+
+const (
+	OK         = "OK"
+	ErrNoGroup = "ErrNoGroup" // Move to a group that has not joined
+)
+
+type JoinArgs struct {
+	GID    int64  // unique replica group ID, not 0
+	Server string // address of the group's viewservice
+}
+
+type JoinReply struct {
+	Err Err
+}
+
+type LeaveArgs struct {
+	GID int64
+}
+
+type LeaveReply struct {
+	Err Err
+}
+
+type MoveArgs struct {
+	Shard int
+	GID   int64
+}
+
+type MoveReply struct {
+	Err Err
+}
+
+type QueryArgs struct {
+	Num int // desired config number, -1 (or past the end) for the latest
+}
+
+type QueryReply struct {
+	Config Config
+}
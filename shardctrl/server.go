@@ -0,0 +1,247 @@
+package shardctrl
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sort"
+
+	"umich.edu/eecs491/proj2/transport"
+)
+
+type ShardCtrl struct {
+	l       net.Listener
+	dead    <-chan interface{}
+	me      string
+	configs []Config // indexed by config num
+
+	// Channels for serialization
+	join_chan  chan *joinReq
+	leave_chan chan *leaveReq
+	move_chan  chan *moveReq
+	query_chan chan *queryReq
+}
+
+type joinReq struct {
+	args  *JoinArgs
+	reply *JoinReply
+	done  chan bool
+}
+
+type leaveReq struct {
+	args  *LeaveArgs
+	reply *LeaveReply
+	done  chan bool
+}
+
+type moveReq struct {
+	args  *MoveArgs
+	reply *MoveReply
+	done  chan bool
+}
+
+type queryReq struct {
+	args  *QueryArgs
+	reply *QueryReply
+	done  chan bool
+}
+
+// Shut down the server
+// Pass the termination channel used in initialization
+func (sc *ShardCtrl) Kill(term chan interface{}) {
+	fmt.Printf("Killing shardctrl %v\n", sc.me)
+	close(term)
+	sc.l.Close()
+}
+
+func (sc *ShardCtrl) isdead() bool {
+	select {
+	case <-sc.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+func StartServer(me string, term <-chan interface{}) *ShardCtrl {
+	sc := new(ShardCtrl)
+	sc.dead = term
+	sc.me = me
+	sc.configs = []Config{{Groups: map[int64]string{}}}
+	sc.join_chan = make(chan *joinReq)
+	sc.leave_chan = make(chan *leaveReq)
+	sc.move_chan = make(chan *moveReq)
+	sc.query_chan = make(chan *queryReq)
+	go sc.run_channels()
+
+	rpcs := rpc.NewServer()
+	rpcs.Register(sc)
+
+	l, e := transport.Listen(sc.me)
+	if e != nil {
+		log.Fatal("listen error: ", e)
+	}
+	sc.l = l
+
+	go func() {
+		for sc.isdead() == false {
+			conn, err := sc.l.Accept()
+			if sc.isdead() {
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+			if err != nil {
+				fmt.Printf("ShardCtrl(%v) accept: %v\n", me, err.Error())
+				continue
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+
+	return sc
+}
+
+// processes every request, one at a time
+func (sc *ShardCtrl) run_channels() {
+	for {
+		select {
+		case req := <-sc.join_chan:
+			sc.joinImpl(req.args, req.reply)
+			req.done <- true
+		case req := <-sc.leave_chan:
+			sc.leaveImpl(req.args, req.reply)
+			req.done <- true
+		case req := <-sc.move_chan:
+			sc.moveImpl(req.args, req.reply)
+			req.done <- true
+		case req := <-sc.query_chan:
+			sc.queryImpl(req.args, req.reply)
+			req.done <- true
+		}
+	}
+}
+
+func (sc *ShardCtrl) Join(args *JoinArgs, reply *JoinReply) error {
+	req := &joinReq{args: args, reply: reply, done: make(chan bool)}
+	sc.join_chan <- req
+	<-req.done
+	return nil
+}
+
+func (sc *ShardCtrl) Leave(args *LeaveArgs, reply *LeaveReply) error {
+	req := &leaveReq{args: args, reply: reply, done: make(chan bool)}
+	sc.leave_chan <- req
+	<-req.done
+	return nil
+}
+
+func (sc *ShardCtrl) Move(args *MoveArgs, reply *MoveReply) error {
+	req := &moveReq{args: args, reply: reply, done: make(chan bool)}
+	sc.move_chan <- req
+	<-req.done
+	return nil
+}
+
+func (sc *ShardCtrl) Query(args *QueryArgs, reply *QueryReply) error {
+	req := &queryReq{args: args, reply: reply, done: make(chan bool)}
+	sc.query_chan <- req
+	<-req.done
+	return nil
+}
+
+// a copy of the latest config, numbered as the next one
+func (sc *ShardCtrl) next() Config {
+	last := sc.configs[len(sc.configs)-1]
+	c := Config{Num: last.Num + 1, Shards: last.Shards, Groups: make(map[int64]string)}
+	for gid, server := range last.Groups {
+		c.Groups[gid] = server
+	}
+	return c
+}
+
+func (sc *ShardCtrl) joinImpl(args *JoinArgs, reply *JoinReply) {
+	c := sc.next()
+	c.Groups[args.GID] = args.Server
+	rebalance(&c)
+	sc.configs = append(sc.configs, c)
+	reply.Err = OK
+}
+
+func (sc *ShardCtrl) leaveImpl(args *LeaveArgs, reply *LeaveReply) {
+	c := sc.next()
+	delete(c.Groups, args.GID)
+	for s := range c.Shards {
+		if c.Shards[s] == args.GID {
+			c.Shards[s] = 0
+		}
+	}
+	rebalance(&c)
+	sc.configs = append(sc.configs, c)
+	reply.Err = OK
+}
+
+func (sc *ShardCtrl) moveImpl(args *MoveArgs, reply *MoveReply) {
+	c := sc.next()
+	if _, ok := c.Groups[args.GID]; !ok || args.Shard < 0 || args.Shard >= NShards {
+		reply.Err = ErrNoGroup
+		return
+	}
+	c.Shards[args.Shard] = args.GID
+	sc.configs = append(sc.configs, c)
+	reply.Err = OK
+}
+
+func (sc *ShardCtrl) queryImpl(args *QueryArgs, reply *QueryReply) {
+	if args.Num < 0 || args.Num >= len(sc.configs) {
+		reply.Config = sc.configs[len(sc.configs)-1]
+		return
+	}
+	reply.Config = sc.configs[args.Num]
+}
+
+//
+// spread the shards evenly over the groups, moving as few as
+// possible: take the extra ones (and any unassigned) away from the
+// groups that have too many, and give them to those with too few.
+// groups go in gid order, so the result depends only on c.
+//
+func rebalance(c *Config) {
+	if len(c.Groups) == 0 {
+		c.Shards = [NShards]int64{}
+		return
+	}
+	gids := make([]int64, 0, len(c.Groups))
+	for gid := range c.Groups {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+	want := make(map[int64]int)
+	for i, gid := range gids {
+		want[gid] = NShards / len(gids)
+		if i < NShards%len(gids) {
+			want[gid]++
+		}
+	}
+	//the first groups get the remainder
+
+	have := make(map[int64]int)
+	var free []int
+	for s, gid := range c.Shards {
+		if _, ok := c.Groups[gid]; !ok || have[gid] >= want[gid] {
+			free = append(free, s)
+			continue
+		}
+		have[gid]++
+	}
+	for _, gid := range gids {
+		for have[gid] < want[gid] {
+			c.Shards[free[0]] = gid
+			free = free[1:]
+			have[gid]++
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package shardctrl
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func port(suffix string) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "shardctrl-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += suffix
+	return s
+}
+
+// every shard is served by a group in c, and no group has more than one shard more than another
+func checkBalanced(t *testing.T, c Config) {
+	counts := make(map[int64]int)
+	for gid := range c.Groups {
+		counts[gid] = 0
+	}
+	for shard, gid := range c.Shards {
+		if _, ok := c.Groups[gid]; !ok {
+			t.Fatalf("config %v: shard %v is with group %v, which is not in it", c.Num, shard, gid)
+		}
+		counts[gid]++
+	}
+	min, max := NShards, 0
+	for _, n := range counts {
+		if n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if max > min+1 {
+		t.Fatalf("config %v is not balanced: %v", c.Num, c.Shards)
+	}
+}
+
+// how many shards are with a different group in b than in a
+func moved(a Config, b Config) int {
+	n := 0
+	for i := range a.Shards {
+		if a.Shards[i] != b.Shards[i] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBasic(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	host := port("basic")
+	term := make(chan interface{})
+	sc := StartServer(host, term)
+	ck := MakeClerk(host)
+
+	fmt.Printf("Test: Initial config ...\n")
+
+	c := ck.Query(-1)
+	if c.Num != 0 || len(c.Groups) != 0 || c.Shards != [NShards]int64{} {
+		t.Fatalf("initial config %v", c)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Join and Leave keep shards balanced ...\n")
+
+	ck.Join(1, "vs1")
+	c1 := ck.Query(-1)
+	if c1.Num != 1 || c1.Groups[1] != "vs1" {
+		t.Fatalf("after Join(1) got config %v", c1)
+	}
+	checkBalanced(t, c1)
+
+	ck.Join(2, "vs2")
+	ck.Join(3, "vs3")
+	c3 := ck.Query(-1)
+	if c3.Num != 3 {
+		t.Fatalf("wanted config 3, got %v", c3.Num)
+	}
+	checkBalanced(t, c3)
+
+	ck.Leave(2)
+	c4 := ck.Query(-1)
+	if _, ok := c4.Groups[2]; ok {
+		t.Fatalf("group 2 still in config %v after Leave", c4.Num)
+	}
+	checkBalanced(t, c4)
+	for i := range c3.Shards {
+		if c3.Shards[i] != 2 && c4.Shards[i] != c3.Shards[i] {
+			t.Fatalf("Leave(2) moved shard %v, which was not group 2's", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Join moves as few shards as it can ...\n")
+
+	ck.Join(4, "vs4")
+	c5 := ck.Query(-1)
+	checkBalanced(t, c5)
+	if n := moved(c4, c5); n > NShards/3+1 {
+		t.Fatalf("Join of a third group moved %v shards", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Move and old configs ...\n")
+
+	if !ck.Move(0, 4) {
+		t.Fatalf("Move to a joined group failed")
+	}
+	c6 := ck.Query(-1)
+	if c6.Num != 6 || c6.Shards[0] != 4 {
+		t.Fatalf("after Move got config %v", c6)
+	}
+	if ck.Move(0, 9) {
+		t.Fatalf("Move to a group that never joined succeeded")
+	}
+	if c := ck.Query(1); c.Num != 1 || c.Shards != c1.Shards {
+		t.Fatalf("Query(1) -> %v, wanted %v", c, c1)
+	}
+	if c := ck.Query(100); c.Num != 6 {
+		t.Fatalf("Query past the end -> config %v, wanted 6", c.Num)
+	}
+
+	ck.Leave(1)
+	ck.Leave(3)
+	ck.Leave(4)
+	c = ck.Query(-1)
+	if len(c.Groups) != 0 || c.Shards != [NShards]int64{} {
+		t.Fatalf("shards still assigned with no groups: %v", c)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	sc.Kill(term)
+}
@@ -0,0 +1,228 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+//
+// Mutual TLS.
+//
+// With Creds, servers listen and clients dial over TLS, and both
+// sides present a certificate signed by one of Roots. The common
+// name of a certificate is who its holder is: for a server, the
+// address it listens at (what views and configs call it), so a
+// client dialing an address only talks to the holder of that
+// name; for a clerk, any name.
+//
+// A server knows who is on the other end of each connection, and
+// Serve hands that to every request that asks for it (see Caller),
+// overwriting whatever name the caller put in the request itself.
+// A nil *Creds means no TLS, and requests keep the names they came
+// with.
+//
+
+type Creds struct {
+	Cert  tls.Certificate // ours, with our name as its common name
+	Roots *x509.CertPool  // CAs for the certificates of everyone we talk to
+}
+
+//
+// RPC arguments that name their caller implement Caller; on a TLS
+// connection, Serve sets the name from the caller's certificate
+// before the request is handled.
+//
+type Caller interface {
+	SetCaller(name string)
+}
+
+// the name in our certificate, "" without one
+func (c *Creds) Name() string {
+	if c == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(c.Cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// like Listen, but over TLS if c is not nil
+func (c *Creds) Listen(addr string) (net.Listener, error) {
+	l, err := Listen(addr)
+	if err != nil || c == nil {
+		return l, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{c.Cert},
+		ClientCAs:    c.Roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// like Dial, but over TLS if c is not nil
+func (c *Creds) Dial(addr string) (*rpc.Client, error) {
+	if c == nil {
+		return Dial(addr)
+	}
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{c.Cert},
+		InsecureSkipVerify: true,
+		VerifyConnection:   c.verifier(addr),
+		MinVersion:         tls.VersionTLS12,
+	}
+	//the name to check is not a host name, so verify by hand
+	conn, err := tls.Dial(Network(addr), addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// check that the server's certificate is signed by Roots, and is for addr
+func (c *Creds) verifier(addr string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         c.Roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		leaf := cs.PeerCertificates[0]
+		_, err := leaf.Verify(opts)
+		if err != nil {
+			return err
+		}
+		if leaf.Subject.CommonName != addr {
+			return fmt.Errorf("certificate is for %q, not %q", leaf.Subject.CommonName, addr)
+		}
+		return nil
+	}
+}
+
+//
+// serve RPCs on conn until it closes. on a TLS connection, requests
+// that implement Caller get the name in the caller's certificate.
+//
+func Serve(rpcs *rpc.Server, conn net.Conn) {
+	ServeUnreliable(rpcs, conn, nil)
+}
+
+//
+// like Serve, but ask drop about each request as it comes in:
+// whether to lose it, or to handle it and lose the reply. either
+// way the connection is closed, as if the network had failed. for
+// testing.
+//
+func ServeUnreliable(rpcs *rpc.Server, conn net.Conn, drop func() (request bool, reply bool)) {
+	caller := ""
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			tc.Close()
+			return
+		}
+		caller = tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	buf := bufio.NewWriter(conn)
+	rpcs.ServeCodec(&serverCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		caller:  caller,
+		drop:    drop,
+		dropped: make(map[uint64]bool),
+	})
+}
+
+// net/rpc's gob codec, plus setting callers and dropping messages
+type serverCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	caller string // "" without TLS
+	drop   func() (bool, bool)
+
+	mu      sync.Mutex
+	dropped map[uint64]bool // requests whose replies are to be lost
+	closed  bool
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.dec.Decode(r)
+	if err != nil || c.drop == nil {
+		return err
+	}
+	request, reply := c.drop()
+	if request {
+		c.Close()
+		return io.EOF
+	}
+	if reply {
+		c.mu.Lock()
+		c.dropped[r.Seq] = true
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	err := c.dec.Decode(body)
+	if err != nil {
+		return err
+	}
+	if args, ok := body.(Caller); ok && c.caller != "" {
+		args.SetCaller(c.caller)
+	}
+	return nil
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mu.Lock()
+	lose := c.dropped[r.Seq]
+	delete(c.dropped, r.Seq)
+	c.mu.Unlock()
+	if lose {
+		c.Close()
+		return io.EOF
+	}
+
+	err := c.enc.Encode(r)
+	if err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err == nil {
+		err = c.encBuf.Flush()
+	}
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+func (c *serverCodec) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"context"
+	"net/rpc"
+	"os"
+	"sync"
+)
+
+//
+// Connection pooling.
+//
+// Instead of dialing for every RPC, callers share one long-lived
+// *rpc.Client per destination, which net/rpc multiplexes between
+// any number of concurrent calls. A connection is dropped, and the
+// next call dials again, once it fails, or (for a unix socket)
+// once the socket at its address is no longer the one it was
+// dialed at, i.e. the server restarted or the address went away.
+//
+// A call that fails on a connection the pool already had is sent
+// once more on a fresh one, since the server may just have gone
+// away in the meantime (an idle connection cannot tell). If the
+// first try did get through, the server sees the call twice, which
+// every RPC here tolerates (clerks' SeqNos, LSNs, page offsets).
+// Any other failure is the caller's to retry, as it always was.
+//
+
+type Pool struct {
+	creds *Creds
+	mu    sync.Mutex
+	conns map[string]*pooled
+}
+
+type pooled struct {
+	client *rpc.Client
+	socket os.FileInfo // a unix socket as it was when we dialed it
+}
+
+var (
+	sharedMu sync.Mutex
+	shared   = make(map[*Creds]*Pool)
+)
+
+func NewPool(creds *Creds) *Pool {
+	return &Pool{creds: creds, conns: make(map[string]*pooled)}
+}
+
+// the pool everyone in this process holding creds (or nil, for no TLS) uses
+func Shared(creds *Creds) *Pool {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	p, ok := shared[creds]
+	if !ok {
+		p = NewPool(creds)
+		shared[creds] = p
+	}
+	return p
+}
+
+// is the unix socket at addr still the one pc was dialed at?
+func (pc *pooled) healthy(addr string) bool {
+	if pc.socket == nil {
+		return true
+	}
+	now, err := os.Stat(addr)
+	return err == nil && os.SameFile(now, pc.socket)
+}
+
+// a client connected to addr, dialing if we have none (or none that looks alive)
+func (p *Pool) Get(addr string) (*rpc.Client, error) {
+	c, _, err := p.get(addr)
+	return c, err
+}
+
+// Get, and whether the client was already in the pool
+func (p *Pool) get(addr string) (*rpc.Client, bool, error) {
+	p.mu.Lock()
+	pc := p.conns[addr]
+	p.mu.Unlock()
+	if pc != nil {
+		if pc.healthy(addr) {
+			return pc.client, true, nil
+		}
+		p.Discard(addr, pc.client)
+	}
+
+	c, err := p.creds.Dial(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	pc = &pooled{client: c}
+	if Network(addr) == "unix" {
+		pc.socket, _ = os.Stat(addr)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur := p.conns[addr]; cur != nil {
+		c.Close()
+		return cur.client, false, nil
+	}
+	//someone else dialed at the same time, keep theirs
+	p.conns[addr] = pc
+	return c, false, nil
+}
+
+// c, from Get(addr), is broken: close it, and dial afresh next time
+func (p *Pool) Discard(addr string, c *rpc.Client) {
+	p.mu.Lock()
+	if pc := p.conns[addr]; pc != nil && pc.client == c {
+		delete(p.conns, addr)
+	}
+	p.mu.Unlock()
+	c.Close()
+}
+
+// call rpcname at addr over a pooled connection
+func (p *Pool) Call(addr string, rpcname string, args interface{}, reply interface{}) error {
+	return p.CallCtx(context.Background(), addr, rpcname, args, reply)
+}
+
+//
+// like Call, but give up with ctx.Err() once ctx is done. the call
+// may still go through after that, and fill in reply.
+//
+func (p *Pool) CallCtx(ctx context.Context, addr string, rpcname string,
+	args interface{}, reply interface{}) error {
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c, reused, err := p.get(addr)
+		if err != nil {
+			return err
+		}
+		call := c.Go(rpcname, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if _, ok := err.(rpc.ServerError); ok || err == nil {
+			return err
+		}
+		//the handler's own error, the connection is fine
+		p.Discard(addr, c)
+		if !reused {
+			return err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+)
+
+//
+// Transport.
+//
+// Every server in this repo is known by a single address string,
+// which is both where it listens and what it tells others (views,
+// shard configs) to dial. An address with a "/" in it, or with no
+// ":", is the path of a unix-domain socket, which is what the tests
+// use; anything else ("host:port") is a TCP address, so replicas
+// can run on separate machines.
+//
+// Servers Listen and clients Dial through this package instead of
+// picking a network themselves.
+//
+
+// which network addr is on, "unix" or "tcp"
+func Network(addr string) string {
+	if strings.Contains(addr, ":") && !strings.Contains(addr, "/") {
+		return "tcp"
+	}
+	return "unix"
+}
+
+//
+// listen for connections at addr. a unix socket left behind by an
+// earlier run at the same path is removed first. closing the
+// listener also closes every connection it accepted, so that
+// clients holding on to one (see Pool) find out the server is gone.
+//
+func Listen(addr string) (net.Listener, error) {
+	network := Network(addr)
+	if network == "unix" {
+		os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: l, conns: make(map[*conn]bool)}, nil
+}
+
+// connect an RPC client to the server at addr
+func Dial(addr string) (*rpc.Client, error) {
+	return rpc.Dial(Network(addr), addr)
+}
+
+type listener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[*conn]bool
+	closed bool
+}
+
+type conn struct {
+	net.Conn
+	l *listener
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &conn{Conn: c, l: l}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		c.Close()
+		return tc, nil
+	}
+	l.conns[tc] = true
+	return tc, nil
+}
+
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	l.mu.Lock()
+	l.closed = true
+	conns := l.conns
+	l.conns = make(map[*conn]bool)
+	l.mu.Unlock()
+	for c := range conns {
+		c.Conn.Close()
+	}
+	return err
+}
+
+func (c *conn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,251 @@
+package transport
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type Echo int
+
+func (e *Echo) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+type WhoArgs struct {
+	Me string
+}
+
+func (args *WhoArgs) SetCaller(name string) {
+	args.Me = name
+}
+
+// who the server thinks is calling
+func (e *Echo) Who(args *WhoArgs, reply *string) error {
+	*reply = args.Me
+	return nil
+}
+
+// serve an Echo at addr until the listener is closed
+func serve(t *testing.T, addr string) func() {
+	return serveCreds(t, nil, addr)
+}
+
+func serveCreds(t *testing.T, creds *Creds, addr string) func() {
+	return serveCounted(t, creds, addr, nil, nil)
+}
+
+// serve an Echo, counting the connections accepted in accepted, and losing what drop says
+func serveCounted(t *testing.T, creds *Creds, addr string, accepted *int32,
+	drop func() (bool, bool)) func() {
+	rpcs := rpc.NewServer()
+	rpcs.Register(new(Echo))
+	l, err := creds.Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen(%v): %v", addr, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if accepted != nil {
+				atomic.AddInt32(accepted, 1)
+			}
+			go ServeUnreliable(rpcs, conn, drop)
+		}
+	}()
+	return func() { l.Close() }
+}
+
+func echo(t *testing.T, addr string) {
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial(%v): %v", addr, err)
+	}
+	defer c.Close()
+	var reply string
+	if err := c.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("Echo over %v -> %v, %v", addr, reply, err)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	fmt.Printf("Test: Addresses pick their network ...\n")
+
+	cases := map[string]string{
+		"/var/tmp/824-0/pb-1":   "unix",
+		"pb-1":                  "unix",
+		"/var/tmp/a:b":          "unix",
+		"localhost:5000":        "tcp",
+		"10.0.0.1:80":           "tcp",
+		"[::1]:5000":            "tcp",
+		"replica.example.org:1": "tcp",
+	}
+	for addr, want := range cases {
+		if got := Network(addr); got != want {
+			t.Fatalf("Network(%v) -> %v, wanted %v", addr, got, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDial(t *testing.T) {
+	fmt.Printf("Test: RPCs over unix and tcp ...\n")
+
+	dir := "/var/tmp/824-" + strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(dir, 0777)
+	unix := dir + "transport-" + strconv.Itoa(os.Getpid())
+	stop := serve(t, unix)
+	echo(t, unix)
+	stop()
+
+	stop = serve(t, unix)
+	echo(t, unix)
+	stop()
+	//a socket file left behind does not get in the way
+
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen on tcp: %v", err)
+	}
+	tcp := l.Addr().String()
+	l.Close()
+	stop = serve(t, tcp)
+	echo(t, tcp)
+	stop()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTLS(t *testing.T) {
+	fmt.Printf("Test: Callers are who their certificates say ...\n")
+
+	ca, err := MakeCA()
+	if err != nil {
+		t.Fatalf("MakeCA: %v", err)
+	}
+	dir := "/var/tmp/824-" + strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(dir, 0777)
+	addr := dir + "transport-tls-" + strconv.Itoa(os.Getpid())
+	server, _ := ca.Issue(addr)
+	alice, _ := ca.Issue("alice")
+	if alice.Name() != "alice" {
+		t.Fatalf("Name() -> %v", alice.Name())
+	}
+
+	stop := serveCreds(t, server, addr)
+	defer stop()
+
+	c, err := alice.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial over TLS: %v", err)
+	}
+	var reply string
+	if err := c.Call("Echo.Who", &WhoArgs{Me: "bob"}, &reply); err != nil || reply != "alice" {
+		t.Fatalf("Who -> %v, %v; wanted alice", reply, err)
+	}
+	c.Close()
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: TLS turns away strangers ...\n")
+
+	if c, err := Dial(addr); err == nil {
+		if c.Call("Echo.Echo", "hi", &reply) == nil {
+			t.Fatalf("call without TLS succeeded")
+		}
+		c.Close()
+	}
+
+	other, _ := MakeCA()
+	mallory, _ := other.Issue("mallory")
+	if c, err := mallory.Dial(addr); err == nil {
+		if c.Call("Echo.Echo", "hi", &reply) == nil {
+			t.Fatalf("call with a certificate from another CA succeeded")
+		}
+		c.Close()
+	}
+
+	// a server whose certificate is for another address
+	addr2 := addr + "-2"
+	stop2 := serveCreds(t, alice, addr2)
+	defer stop2()
+	if _, err := alice.Dial(addr2); err == nil {
+		t.Fatalf("dialed %v, which has a certificate for alice", addr2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPool(t *testing.T) {
+	fmt.Printf("Test: Calls share a connection ...\n")
+
+	dir := "/var/tmp/824-" + strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(dir, 0777)
+	addr := dir + "transport-pool-" + strconv.Itoa(os.Getpid())
+	var accepted int32
+	stop := serveCounted(t, nil, addr, &accepted, nil)
+
+	p := NewPool(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				var reply string
+				arg := strconv.Itoa(i*10 + j)
+				if err := p.Call(addr, "Echo.Echo", arg, &reply); err != nil || reply != arg {
+					t.Errorf("Echo(%v) -> %v, %v", arg, reply, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&accepted); n > 10 {
+		t.Fatalf("100 calls made %v connections", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Pool redials a restarted server ...\n")
+
+	stop()
+	before := atomic.LoadInt32(&accepted)
+	stop = serveCounted(t, nil, addr, &accepted, nil)
+	var reply string
+	if err := p.Call(addr, "Echo.Echo", "again", &reply); err != nil || reply != "again" {
+		t.Fatalf("Echo after a restart -> %v, %v", reply, err)
+	}
+	if atomic.LoadInt32(&accepted) == before {
+		t.Fatalf("no new connection to the restarted server")
+	}
+	stop()
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A reply lost mid-call breaks only that call ...\n")
+
+	var lost int32 = 1
+	drop := func() (bool, bool) {
+		return false, atomic.CompareAndSwapInt32(&lost, 1, 0)
+	}
+	stop = serveCounted(t, nil, addr, &accepted, drop)
+	defer stop()
+	if err := p.Call(addr, "Echo.Echo", "lost", &reply); err == nil {
+		t.Fatalf("call whose reply was lost succeeded")
+	}
+	if err := p.Call(addr, "Echo.Echo", "found", &reply); err != nil || reply != "found" {
+		t.Fatalf("Echo after a lost reply -> %v, %v", reply, err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
@@ -2,7 +2,8 @@ package viewservice
 
 import (
 	"fmt"
-	"net/rpc"
+
+	"umich.edu/eecs491/proj2/transport"
 )
 
 //
@@ -10,14 +11,36 @@ import (
 // and maintains a little state.
 //
 type Clerk struct {
-	me     string // client's name (host:port)
-	server string // viewservice's host:port
+	me      string           // client's name (host:port)
+	servers []string         // viewservice replicas' host:port
+	leader  int              // index of the replica that last answered
+	creds   *transport.Creds // nil for no TLS
 }
 
 func MakeClerk(me string, server string) *Clerk {
+	return MakeGroupClerk(me, []string{server})
+}
+
+//
+// a Clerk that talks to the viewservice over TLS, as the
+// holder of creds (see transport). me should be the name in
+// its certificate.
+//
+func MakeClerkWithCreds(me string, server string, creds *transport.Creds) *Clerk {
+	ck := MakeClerk(me, server)
+	ck.creds = creds
+	return ck
+}
+
+//
+// a Clerk for a replicated view service. RPCs go to whichever
+// replica answered last, and fail over to the others in turn.
+//
+func MakeGroupClerk(me string, servers []string) *Clerk {
 	ck := new(Clerk)
 	ck.me = me
-	ck.server = server
+	ck.servers = servers
+	ck.leader = 0
 	return ck
 }
 
@@ -31,47 +54,73 @@ func MakeClerk(me string, server string) *Clerk {
 // if call() was not able to contact the server. in particular,
 // the reply's contents are only valid if call() returned true.
 //
+// with creds, the call goes over TLS (see transport). calls
+// share one connection per server with everyone else in the
+// process (see transport.Pool).
+//
 // you should assume that call() will return an
 // error after a while if the server is dead.
 // don't provide your own time-out mechanism.
 //
-func call(srv string, rpcname string,
+func call(creds *transport.Creds, srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
-	if errx != nil {
-		return false
-	}
-	defer c.Close()
+	err := transport.Shared(creds).Call(srv, rpcname, args, reply)
+	return err == nil
+}
 
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
+//
+// try each replica once, starting with the last one that
+// answered. false if none of them did.
+//
+func (ck *Clerk) callAny(rpcname string, args interface{}, reply interface{}) bool {
+	for i := 0; i < len(ck.servers); i++ {
+		srv := (ck.leader + i) % len(ck.servers)
+		if call(ck.creds, ck.servers[srv], rpcname, args, reply) {
+			ck.leader = srv
+			return true
+		}
 	}
-
-	fmt.Println(err)
 	return false
 }
 
 func (ck *Clerk) Ping(viewnum uint) (View, error) {
+	return ck.PingRecovered(viewnum, 0)
+}
+
+//
+// Ping for a server that restarted with state recovered from
+// disk; recovered is the view # that state belongs to.
+//
+func (ck *Clerk) PingRecovered(viewnum uint, recovered uint) (View, error) {
+	view, _, err := ck.PingLease(viewnum, recovered)
+	return view, err
+}
+
+//
+// PingRecovered, also reporting whether the caller is primary and
+// holds a lease for LeaseDuration from when PingLease was called.
+//
+func (ck *Clerk) PingLease(viewnum uint, recovered uint) (View, bool, error) {
 	// prepare the arguments.
 	args := &PingArgs{}
 	args.Me = ck.me
 	args.Viewnum = viewnum
+	args.Recovered = recovered
 	var reply PingReply
 
 	// send an RPC request, wait for the reply.
-	ok := call(ck.server, "ViewServer.Ping", args, &reply)
+	ok := ck.callAny("ViewServer.Ping", args, &reply)
 	if ok == false {
-		return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
+		return View{}, false, fmt.Errorf("Ping(%v) failed", viewnum)
 	}
 
-	return reply.View, nil
+	return reply.View, reply.Lease, nil
 }
 
 func (ck *Clerk) Get() (View, bool) {
 	args := &GetArgs{}
 	var reply GetReply
-	ok := call(ck.server, "ViewServer.Get", args, &reply)
+	ok := ck.callAny("ViewServer.Get", args, &reply)
 	if ok == false {
 		return View{}, false
 	}
@@ -3,17 +3,25 @@ package viewservice
 import "time"
 
 //
-// This is a non-replicated view service for a simple
-// primary/backup system.
+// This is a view service for a simple primary/backup system.
+// It runs either as a single server or, to survive the loss
+// of a view server, as a small replicated group that agrees
+// on every step through Paxos (see group.go).
 //
 // The view service goes through a sequence of numbered
-// views, each with a primary and (if possible) a backup.
+// views, each with a primary and (if possible) a number of
+// backups, one unless configured otherwise (Options.Backups).
 // A view consists of a view number and the host:port of
 // the view's primary and backup p/b servers.
 //
 // The primary in a view is always either the primary
-// or the backup of the previous view (in order to ensure
-// that the p/b service's state is preserved).
+// or the first backup of the previous view (in order to
+// ensure that the p/b service's state is preserved).
+//
+// In chain mode (Options.Chain) the same view describes a
+// chain instead: the primary is the head, where writes come
+// in, the backups follow in order, and the last one, the
+// tail, serves reads.
 //
 // Each p/b server should send a Ping RPC once per PingInterval.
 // The view server replies with a description of the current
@@ -36,7 +44,27 @@ import "time"
 type View struct {
 	Viewnum uint
 	Primary string
-	Backup  string
+	Backup  string   // the first of Backups, "" if there are none
+	Backups []string // in the order they would be promoted
+	Chain   bool     // Primary and Backups form a replication chain
+}
+
+// is server one of the view's backups?
+func (v View) IsBackup(server string) bool {
+	for _, b := range v.Backups {
+		if b == server {
+			return true
+		}
+	}
+	return false
+}
+
+// the end of the chain: the last backup, or the primary if there are none
+func (v View) Tail() string {
+	if len(v.Backups) == 0 {
+		return v.Primary
+	}
+	return v.Backups[len(v.Backups)-1]
 }
 
 // clients should send a Ping RPC this often,
@@ -47,6 +75,20 @@ const PingInterval = time.Millisecond * 100
 // this many Ping RPCs in a row.
 const DeadPings = 5
 
+// each Ping from the primary renews its lease, during which the
+// viewserver will not make anyone else primary: the viewserver
+// waits more than LeaseTicks ticks after the renewal, and the
+// primary counts its lease as lasting LeaseDuration from when it
+// sent the Ping, half as long, to allow for clocks and ticks that
+// run fast.
+const LeaseTicks = DeadPings
+const LeaseDuration = PingInterval * LeaseTicks / 2
+
+// a viewserver restarted from saved state waits this many
+// PingIntervals before declaring any server dead, so that the
+// servers have a chance to ping it again.
+const RestartGrace = DeadPings * 2
+
 //
 // Ping(): called by a primary/backup server to tell the
 // view service it is alive, to indicate whether p/b server
@@ -56,14 +98,27 @@ const DeadPings = 5
 // If Viewnum is zero, the caller is signalling that it is
 // alive and could become backup if needed.
 //
+// A p/b server that restarted from its on-disk log reports the
+// view # its recovered state belongs to in Recovered. It is still
+// treated as a fresh server (and gets its state pushed to it like
+// any other backup), except that when every initialized server is
+// gone the view service may make it primary rather than wait forever.
+//
 
 type PingArgs struct {
-	Me      string // "host:port"
-	Viewnum uint   // caller's notion of current view #
+	Me        string // "host:port"
+	Viewnum   uint   // caller's notion of current view #
+	Recovered uint   // view # of state recovered from disk, 0 if none
+}
+
+// on a TLS connection, the caller is who its certificate says
+func (args *PingArgs) SetCaller(name string) {
+	args.Me = name
 }
 
 type PingReply struct {
-	View View
+	View  View
+	Lease bool // the caller is primary, with a lease renewed by this Ping
 }
 
 //
@@ -0,0 +1,349 @@
+package viewservice
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"log"
+	"math/big"
+	"time"
+
+	"umich.edu/eecs491/proj2/paxos"
+)
+
+//
+// Replicated view service.
+//
+// When started with a list of peers, each ViewServer is one
+// replica of a group. The replicas agree on a Paxos log of the
+// inputs to the view service -- Pings, Gets and ticks -- and each
+// applies that log, in order, to its own copy of the state using
+// exactly the same code as a lone view server. So every replica
+// moves through the same views, and the rule that a view does not
+// advance until its primary acks it holds for the group as a whole.
+// A Ping or Get is answered once it has been agreed on and applied.
+//
+// Ticks need care: tick_count decides when a server is dead, so it
+// must advance once per PingInterval no matter how many replicas
+// there are. Only one replica, the ticker, puts ticks into the log.
+// The others watch the log, and if no tick from the ticker has
+// shown up for DeadPings intervals one of them starts ticking
+// instead; applying a tick makes its sender the ticker.
+//
+// The group keeps working as long as a majority of the replicas
+// can talk to each other. Nothing is written to disk in this mode,
+// so a replica that restarts knows nothing, and the others have long
+// since forgotten the log entries it would need to replay. Every
+// replica therefore starts out rejoining: it asks the others for
+// their state, takes the most advanced copy, and goes on from the
+// log entry after it. Until then it answers no Pings or Gets, and
+// does not vote in Paxos. A group started from scratch finds
+// everyone rejoining, and starts from nothing.
+//
+// A replica that voted before it restarted has forgotten how, and
+// could undo an agreement if it voted again. If any of the others
+// knows it voted, it comes back without a vote: it follows the log
+// and answers clerks, but the group keeps working only as long as
+// a majority of the replicas that still vote are up. Until someone
+// says it voted, a replica cannot tell a restart from a first start,
+// so it waits to hear from every other replica.
+//
+
+// give up on getting an op into the log after this long, so
+// clerks can try another replica.
+const AgreeTimeout = PingInterval * DeadPings * 2
+
+// Kinds of log entries
+const (
+	opPing = iota
+	opGet
+	opTick
+)
+
+type Op struct {
+	Kind int
+	ID   int64 // lets a replica spot its own proposal in the log
+	From int   // index of the replica that proposed it
+	Ping PingArgs
+}
+
+var errNoAgreement = errors.New("no agreement among view service replicas")
+
+// Rejoin(): a restarted replica asks another for its state
+type RejoinArgs struct {
+	Me int // index of the asking replica
+}
+
+type RejoinReply struct {
+	Rejoining bool       // we are rejoining ourselves, and know nothing yet
+	Voted     bool       // the asker voted in Paxos before it restarted
+	Done      int        // how far the asker told us it was done, before it restarted
+	Applied   int        // the last log entry State reflects
+	State     GroupState
+}
+
+// a replica's copy of the view service state
+type GroupState struct {
+	View       View
+	LastPing   map[string]int
+	ServerView map[string]uint
+	TickCount  int
+	Recovered  map[string]uint
+	Acked      View
+	LeaseTick  int
+	Ticker     int
+}
+
+func init() {
+	gob.Register(Op{})
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64()
+}
+
+//
+// get op into the log, applying everything decided before it.
+// returns the view as it stood right after op was applied.
+//
+func (vs *ViewServer) agree(op Op) (View, error) {
+	op.ID = nrand()
+	op.From = vs.impl.me_index
+	deadline := time.Now().Add(AgreeTimeout)
+	for {
+		seq := vs.impl.applied + 1
+		vs.impl.px.Start(seq, op)
+
+		decided, ok := vs.wait_decided(seq, deadline)
+		if !ok {
+			return View{}, errNoAgreement
+		}
+		vs.apply(decided)
+		vs.impl.px.Done(vs.impl.applied)
+		if decided.ID == op.ID {
+			return vs.impl.cur_view, nil
+		}
+		//someone else got this slot, try the next one
+	}
+}
+
+func (vs *ViewServer) wait_decided(seq int, deadline time.Time) (Op, bool) {
+	to := 5 * time.Millisecond
+	for time.Now().Before(deadline) && !vs.isdead() {
+		fate, v := vs.impl.px.Status(seq)
+		if fate == paxos.Decided {
+			return v.(Op), true
+		}
+		select {
+		case req := <-vs.impl.rejoin_chan:
+			vs.rejoin_impl_internal(req.args, req.reply)
+			req.done <- true
+		case <-time.After(to):
+		}
+		//the others may need us to rejoin before they can agree
+		if to < PingInterval {
+			to *= 2
+		}
+	}
+	return Op{}, false
+}
+
+// apply everything already decided, without proposing anything
+func (vs *ViewServer) catch_up() {
+	for {
+		fate, v := vs.impl.px.Status(vs.impl.applied + 1)
+		if fate != paxos.Decided {
+			break
+		}
+		vs.apply(v.(Op))
+	}
+	vs.impl.px.Done(vs.impl.applied)
+}
+
+// apply the next log entry to our copy of the state
+func (vs *ViewServer) apply(op Op) {
+	vs.impl.applied++
+	switch op.Kind {
+	case opPing:
+		var reply PingReply
+		vs.ping_impl_internal(&op.Ping, &reply)
+	case opGet:
+	case opTick:
+		if op.From == vs.impl.ticker {
+			vs.impl.ticker_seen = time.Now()
+		}
+		vs.impl.ticker = op.From
+		vs.tick_internal()
+	}
+}
+
+//
+// tick for a replica: catch up on the log, then put a tick in it
+// if we are the ticker or the ticker seems to have gone quiet.
+//
+func (vs *ViewServer) group_tick() {
+	vs.catch_up()
+	quiet := time.Since(vs.impl.ticker_seen) > PingInterval*DeadPings
+	if vs.impl.ticker == vs.impl.me_index || quiet {
+		vs.agree(Op{Kind: opTick})
+	}
+}
+
+// RejoinImpl() sends the req through the channel, like PingImpl()
+func (vs *ViewServer) RejoinImpl(args *RejoinArgs, reply *RejoinReply) error {
+	req := &rejoinReq{
+		args:  args,
+		reply: reply,
+		done:  make(chan bool),
+	}
+	vs.impl.rejoin_chan <- req
+	<-req.done
+	return nil
+}
+
+// tell a rejoining replica where we are (runs in run_channels goroutine)
+func (vs *ViewServer) rejoin_impl_internal(args *RejoinArgs, reply *RejoinReply) {
+	if !vs.has_rejoined() {
+		reply.Rejoining = true
+		return
+	}
+	reply.Voted = vs.impl.px.Voted(args.Me)
+	reply.Done = vs.impl.px.PeerDone(args.Me)
+	reply.Applied = vs.impl.applied
+	reply.State = GroupState{
+		View:       vs.impl.cur_view,
+		LastPing:   make(map[string]int),
+		ServerView: make(map[string]uint),
+		TickCount:  vs.impl.tick_count,
+		Recovered:  make(map[string]uint),
+		Acked:      vs.impl.acked,
+		LeaseTick:  vs.impl.lease_tick,
+		Ticker:     vs.impl.ticker,
+	}
+	for server, tick := range vs.impl.last_ping {
+		reply.State.LastPing[server] = tick
+	}
+	for server, viewnum := range vs.impl.server_view {
+		reply.State.ServerView[server] = viewnum
+	}
+	for server, viewnum := range vs.impl.recovered {
+		reply.State.Recovered[server] = viewnum
+	}
+	//the reply is encoded after we return, while we go on changing ours
+}
+
+//
+// ask the other replicas for their state until rejoinable() is
+// happy with the answers, then hand them to run_channels.
+//
+func (vs *ViewServer) rejoin() {
+	for !vs.isdead() {
+		var replies []RejoinReply
+		for i, peer := range vs.impl.peers {
+			if i == vs.impl.me_index {
+				continue
+			}
+			var reply RejoinReply
+			if call(nil, peer, "ViewServer.Rejoin", &RejoinArgs{Me: vs.impl.me_index}, &reply) {
+				replies = append(replies, reply)
+			}
+		}
+		if rejoinable(len(vs.impl.peers), replies) {
+			vs.impl.settle_chan <- replies
+			return
+		}
+		time.Sleep(PingInterval / 4)
+	}
+}
+
+//
+// can a replica of a group of n rejoin with these replies from the
+// others? yes once one of them knows we voted before, or everyone
+// has answered; and if we had already applied some of the log, once
+// one of them has applied as much, since the others may have
+// forgotten those entries.
+//
+func rejoinable(n int, replies []RejoinReply) bool {
+	voted, need, best := false, -1, -1
+	for _, r := range replies {
+		if r.Rejoining {
+			continue
+		}
+		voted = voted || r.Voted
+		if r.Done > need {
+			need = r.Done
+		}
+		if r.Applied > best {
+			best = r.Applied
+		}
+	}
+	if !voted && len(replies) < n-1 {
+		return false
+	}
+	return best >= need
+}
+
+// take the most advanced state among replies, and go on from there (runs in run_channels goroutine)
+func (vs *ViewServer) settle(replies []RejoinReply) {
+	voted := false
+	var from *RejoinReply
+	for i := range replies {
+		r := &replies[i]
+		if r.Rejoining {
+			continue
+		}
+		voted = voted || r.Voted
+		if from == nil || r.Applied > from.Applied {
+			from = r
+		}
+	}
+
+	if from != nil {
+		st := &from.State
+		vs.impl.cur_view = st.View
+		for server, tick := range st.LastPing {
+			vs.impl.last_ping[server] = tick
+		}
+		for server, viewnum := range st.ServerView {
+			vs.impl.server_view[server] = viewnum
+		}
+		for server, viewnum := range st.Recovered {
+			vs.impl.recovered[server] = viewnum
+		}
+		//gob leaves out empty maps, so fill in ours rather than take theirs
+		vs.impl.tick_count = st.TickCount
+		vs.impl.acked = st.Acked
+		vs.impl.lease_tick = st.LeaseTick
+		vs.impl.ticker = st.Ticker
+		vs.impl.applied = from.Applied
+		vs.impl.px.Done(vs.impl.applied)
+	}
+	vs.impl.ticker_seen = time.Now()
+	if voted {
+		log.Printf("ViewServer(%v) restarted, rejoining without a vote\n", vs.me)
+	} else {
+		vs.impl.px.SitOut(-1)
+	}
+	close(vs.impl.rejoined)
+}
+
+func (vs *ViewServer) has_rejoined() bool {
+	select {
+	case <-vs.impl.rejoined:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait a while for a replica to rejoin its group, false if it has not
+func (vs *ViewServer) wait_rejoined() bool {
+	select {
+	case <-vs.impl.rejoined:
+		return true
+	case <-time.After(AgreeTimeout):
+		return false
+	}
+}
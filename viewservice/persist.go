@@ -0,0 +1,65 @@
+package viewservice
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+)
+
+//
+// On-disk copy of the view server's state, so that a restarted
+// view server carries on with the same view instead of view 0.
+//
+// Everything is kept in one gob-encoded file that is rewritten
+// whenever the view or a server's acknowledged view # changes.
+// The new copy goes to a temp file first and is renamed into
+// place, so a crash leaves either the old or the new state.
+//
+
+const stateFile = "viewstate"
+
+type savedState struct {
+	View       View
+	ServerView map[string]uint
+	Recovered  map[string]uint
+	Acked      View
+}
+
+// read the saved state in dir. ok is false if there is none.
+func loadState(dir string) (savedState, bool, error) {
+	var st savedState
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return st, false, nil
+	} else if err != nil {
+		return st, false, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		return st, false, err
+	}
+	return st, true, nil
+}
+
+func saveState(dir string, st savedState) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, stateFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, filepath.Join(dir, stateFile))
+}
@@ -6,9 +6,10 @@ import (
 	"log"
 	"net"
 	"net/rpc"
-	"os"
 	"sync/atomic"
 	"time"
+
+	"umich.edu/eecs491/proj2/transport"
 )
 
 type ViewServer struct {
@@ -44,20 +45,41 @@ func (vs *ViewServer) GetRPCCount() int32 {
 	return atomic.LoadInt32(&vs.rpccount)
 }
 
+// Optional server settings; the zero value gives the original
+// in-memory view server.
+type Options struct {
+	Dir     string           // directory to save view state in, "" for none
+	Peers   []string         // every replica of a replicated group, including me
+	Backups int              // backups per view, 1 if zero
+	Chain   bool             // have views describe a replication chain
+	Creds   *transport.Creds // listen over TLS, and take a Ping's Me from the caller's certificate
+}
+
 func StartServer(me string, term <-chan interface{}) *ViewServer {
+	return StartServerWithOptions(me, Options{}, term)
+}
+
+//
+// start a view server that saves its state in opts.Dir, and
+// picks up from the state saved there by an earlier run.
+//
+// with more than one opts.Peers, the server is instead one replica
+// of a replicated view service (see group.go), and Dir is unused.
+//
+func StartServerWithOptions(me string, opts Options, term <-chan interface{}) *ViewServer {
 	vs := new(ViewServer)
 	vs.dead = term
 	vs.me = me
-	vs.initImpl()
 
 	// tell net/rpc about our RPC server and handlers.
 	rpcs := rpc.NewServer()
 	rpcs.Register(vs)
+	vs.initImpl(opts, rpcs)
 
 	// prepare to receive connections from clients.
-	// change "unix" to "tcp" to use over a network.
-	os.Remove(vs.me) // only needed for "unix"
-	l, e := net.Listen("unix", vs.me)
+	// a "host:port" address listens on tcp (see transport),
+	// over TLS with opts.Creds.
+	l, e := opts.Creds.Listen(vs.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -82,16 +104,18 @@ func StartServer(me string, term <-chan interface{}) *ViewServer {
 			}
 			// We are not dead, and have a valid connection
 			// Serve it asynchronously
-			atomic.AddInt32(&vs.rpccount, 1)
-			go rpcs.ServeConn(conn)
+			go transport.Serve(rpcs, conn)
 		}
 	}()
 
 	// create a thread to call tick() periodically.
+	// on a ticker, so ticks do not fall behind the pings they count.
 	go func() {
+		ticker := time.NewTicker(PingInterval)
+		defer ticker.Stop()
 		for vs.isdead() == false {
 			vs.tick()
-			time.Sleep(PingInterval)
+			<-ticker.C
 		}
 	}()
 
@@ -103,6 +127,7 @@ func StartServer(me string, term <-chan interface{}) *ViewServer {
 // Ping Wrapper
 //
 func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
+	atomic.AddInt32(&vs.rpccount, 1)
 	if vs.isdead() {
 		errString := "Server " + vs.me + " is dead"
 		return errors.New(errString)
@@ -111,10 +136,23 @@ func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
 	}
 }
 
+//
+// Rejoin Wrapper, for the other replicas of a group
+//
+func (vs *ViewServer) Rejoin(args *RejoinArgs, reply *RejoinReply) error {
+	if vs.isdead() {
+		errString := "Server " + vs.me + " is dead"
+		return errors.New(errString)
+	} else {
+		return vs.RejoinImpl(args, reply)
+	}
+}
+
 //
 // Get Wrapper
 //
 func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
+	atomic.AddInt32(&vs.rpccount, 1)
 	if vs.isdead() {
 		errString := "Server " + vs.me + " is dead"
 		return errors.New(errString)
@@ -1,8 +1,20 @@
 package viewservice
 
+import (
+	"log"
+	"math"
+	"net/rpc"
+	"os"
+	"sort"
+	"time"
+
+	"umich.edu/eecs491/proj2/paxos"
+)
+
 type pingReq struct {
 	args  *PingArgs
 	reply *PingReply
+	err   error
 	done  chan bool
 }
 // for the ping channel
@@ -10,6 +22,7 @@ type pingReq struct {
 type getReq struct {
 	args  *GetArgs
 	reply *GetReply
+	err   error
 	done  chan bool
 }
 // get channel
@@ -19,28 +32,89 @@ type tickReq struct {
 }
 // tick channel
 
+type rejoinReq struct {
+	args  *RejoinArgs
+	reply *RejoinReply
+	done  chan bool
+}
+// another replica asking for our state
+
 type ViewServerImpl struct {
 	cur_view View //current view
 	last_ping    map[string]int
 	server_view  map[string]uint
 	tick_count   int
+	recovered    map[string]uint // view # each restarted server recovered from disk
+	acked        View            // latest view its primary acknowledged
+	dir          string          // where to save state, "" for nowhere
+	grace        int             // don't declare anyone dead until tick_count passes this
+	nbackups     int             // how many backups a view should have
+	lease_tick   int             // tick_count when the primary last renewed its lease
+
+	// Replicated group only, see group.go
+	px           *paxos.Paxos // nil for a lone view server
+	peers        []string     // every replica of the group
+	me_index     int          // our index in the group
+	rejoined     chan bool    // closed once we are up to date with the rest of the group
+	applied      int          // highest log entry applied to the state above
+	ticker       int          // replica whose ticks drive tick_count
+	ticker_seen  time.Time    // when we last applied a tick from the ticker
 	
 	// Channels for serialization
-	ping_chan chan *pingReq
-	get_chan  chan *getReq
-	tick_chan chan *tickReq
+	ping_chan   chan *pingReq
+	get_chan    chan *getReq
+	tick_chan   chan *tickReq
+	rejoin_chan chan *rejoinReq        // another replica wants our state
+	settle_chan chan []RejoinReply     // what the others told us, once we can rejoin
 }
 
-func (vs *ViewServer) initImpl() {
+func (vs *ViewServer) initImpl(opts Options, rpcs *rpc.Server) {
 	vs.impl = ViewServerImpl{
 		cur_view: View{Viewnum: 0, Primary: "", Backup: ""},
 		last_ping:    make(map[string]int),
 		server_view:  make(map[string]uint),
 		tick_count:   0,
+		recovered:    make(map[string]uint),
 		ping_chan:    make(chan *pingReq),
 		get_chan:     make(chan *getReq),
 		tick_chan:    make(chan *tickReq),
+		rejoin_chan:  make(chan *rejoinReq),
+		settle_chan:  make(chan []RejoinReply),
+		rejoined:     make(chan bool),
+		dir:          opts.Dir,
+		applied:      -1,
+		ticker_seen:  time.Now(),
+		nbackups:     opts.Backups,
+	}
+	if vs.impl.nbackups <= 0 {
+		vs.impl.nbackups = 1
+	}
+	if len(opts.Peers) > 1 {
+		vs.impl.dir = ""
+		vs.impl.me_index = -1
+		for i, peer := range opts.Peers {
+			if peer == vs.me {
+				vs.impl.me_index = i
+			}
+		}
+		if vs.impl.me_index < 0 {
+			log.Fatal("view server ", vs.me, " is not one of its peers")
+		}
+		if opts.Creds != nil {
+			log.Fatal("view server ", vs.me, ": a replicated group cannot use TLS")
+		}
+		//paxos dials its peers itself, without certificates
+		vs.impl.px = paxos.Make(opts.Peers, vs.impl.me_index, rpcs, vs.dead)
+		vs.impl.px.SitOut(math.MaxInt)
+		vs.impl.peers = opts.Peers
+		go vs.rejoin()
+	} else {
+		close(vs.impl.rejoined)
 	}
+	//a group replicates its state instead of saving it, and a replica
+	//knows nothing until the others fill it in
+	vs.restore()
+	vs.impl.cur_view.Chain = opts.Chain
 	
 	// Start run_channels
 	go vs.run_channels()
@@ -51,22 +125,45 @@ func (vs *ViewServer) run_channels() {
 	for {
 		select {
 		case req := <-vs.impl.ping_chan:
-			vs.ping_impl_internal(req.args, req.reply)
+			if vs.impl.px != nil {
+				req.reply.View, req.err = vs.agree(Op{Kind: opPing, Ping: *req.args})
+				req.reply.Lease = req.err == nil && vs.impl.grants_lease(req.args)
+			} else {
+				vs.ping_impl_internal(req.args, req.reply)
+			}
 			req.done <- true
 			// finish up ping_chan
 		case req := <-vs.impl.get_chan:
-			vs.get_impl_internal(req.reply)
+			if vs.impl.px != nil {
+				req.reply.View, req.err = vs.agree(Op{Kind: opGet})
+			} else {
+				vs.get_impl_internal(req.reply)
+			}
 			req.done <- true
 			//finish up get_chan
 		case req := <-vs.impl.tick_chan:
-			vs.tick_internal()
+			if vs.impl.px != nil {
+				if vs.has_rejoined() {
+					vs.group_tick()
+				}
+			} else {
+				vs.tick_internal()
+			}
 			req.done <- true
 			//finish up tick_chan
+		case req := <-vs.impl.rejoin_chan:
+			vs.rejoin_impl_internal(req.args, req.reply)
+			req.done <- true
+		case replies := <-vs.impl.settle_chan:
+			vs.settle(replies)
 		}
 	}
 }
 
 func (vs *ViewServer) PingImpl(args *PingArgs, reply *PingReply) error {
+	if !vs.wait_rejoined() {
+		return errNoAgreement
+	}
 	req := &pingReq{
 		args:  args,
 		reply: reply,
@@ -74,12 +171,14 @@ func (vs *ViewServer) PingImpl(args *PingArgs, reply *PingReply) error {
 	}
 	vs.impl.ping_chan <- req
 	<-req.done
-	return nil
+	return req.err
 	//for the channel
 }
 
 func (vs *ViewServer) ping_impl_internal(args *PingArgs, reply *PingReply) {
-	vs.me = args.Me
+	old_view := vs.impl.cur_view
+	old_ack, old_recovered := vs.impl.server_view[args.Me], vs.impl.recovered[args.Me]
+
 	vs.impl.last_ping[args.Me] = vs.impl.tick_count
 	//update tick_count
 	if vs.impl.cur_view.Primary == "" {
@@ -87,20 +186,38 @@ func (vs *ViewServer) ping_impl_internal(args *PingArgs, reply *PingReply) {
 		vs.impl.cur_view.Viewnum++
 	}
 	//change view
-	if vs.impl.cur_view.Primary != "" && vs.impl.cur_view.Backup == "" && vs.impl.cur_view.Primary != args.Me {
+	if vs.impl.cur_view.Primary != "" && len(vs.impl.cur_view.Backups) < vs.impl.nbackups &&
+		vs.impl.cur_view.Primary != args.Me && !vs.impl.cur_view.IsBackup(args.Me) {
 		primary_ack := (vs.impl.server_view[vs.impl.cur_view.Primary] == vs.impl.cur_view.Viewnum)
 		if primary_ack {
-			vs.impl.cur_view.Backup = args.Me
+			vs.impl.add_backup(args.Me)
 			vs.impl.cur_view.Viewnum++
 		}
 	}
 	//check for idle server and ack, then assign backup
 	vs.impl.server_view[args.Me] = args.Viewnum
+	vs.impl.recovered[args.Me] = args.Recovered
+	if args.Me == vs.impl.cur_view.Primary && args.Viewnum == vs.impl.cur_view.Viewnum {
+		vs.impl.acked = vs.impl.cur_view
+	}
+	if vs.impl.grants_lease(args) {
+		vs.impl.lease_tick = vs.impl.tick_count
+		reply.Lease = true
+	}
+	//renew the primary's lease
 	reply.View = vs.impl.cur_view
 	//update views
+
+	if vs.impl.cur_view.Viewnum != old_view.Viewnum || args.Viewnum != old_ack || args.Recovered != old_recovered {
+		vs.save()
+	}
+	//only hit the disk when something we remember changed
 }
 
 func (vs *ViewServer) GetImpl(args *GetArgs, reply *GetReply) error {
+	if !vs.wait_rejoined() {
+		return errNoAgreement
+	}
 	req := &getReq{
 		args:  args,
 		reply: reply,
@@ -108,7 +225,7 @@ func (vs *ViewServer) GetImpl(args *GetArgs, reply *GetReply) error {
 	}
 	vs.impl.get_chan <- req
 	<-req.done
-	return nil
+	return req.err
 	//for the get_channel
 }
 
@@ -128,47 +245,46 @@ func (vs *ViewServer) tick() {
 
 func (vs *ViewServer) tick_internal() {
 	vs.impl.tick_count++
+	if vs.impl.tick_count <= vs.impl.grace {
+		return
+	}
+	//just restarted, give everyone a chance to ping before judging them
 
 	changed_view := false
-	for server, lastTick := range vs.impl.last_ping {
-		if vs.impl.tick_count-lastTick > DeadPings {
+	for _, server := range vs.impl.servers() {
+		if vs.impl.tick_count-vs.impl.last_ping[server] > DeadPings {
 			if vs.impl.server_view[vs.impl.cur_view.Primary] == 0 {
 				vs.impl.cur_view.Primary = ""
-				vs.impl.cur_view.Backup = ""
+				vs.impl.set_backups(nil)
 				changed_view = true
 			}
-			//if view restarted, reset primary and backup
+			//if view restarted, reset primary and backups
 			if vs.impl.cur_view.Primary != "" && (vs.impl.tick_count-vs.impl.last_ping[vs.impl.cur_view.Primary] > DeadPings) {
 				primary_ack := vs.impl.server_view[vs.impl.cur_view.Primary] == vs.impl.cur_view.Viewnum
-				if primary_ack && vs.impl.cur_view.Backup != "" {
-					vs.impl.cur_view.Primary = vs.impl.cur_view.Backup
-					vs.impl.cur_view.Backup = ""
+				if primary_ack && len(vs.impl.cur_view.Backups) > 0 && vs.impl.lease_expired() {
+					vs.impl.cur_view.Primary = vs.impl.cur_view.Backups[0]
+					vs.impl.set_backups(vs.impl.cur_view.Backups[1:])
 					changed_view = true
 				}
 			}
-			//check for nonblank primary and if it's dead, then make backup new primary
-			if vs.impl.cur_view.Backup == server {
-				vs.impl.cur_view.Backup = ""
+			//check for nonblank primary and if it's dead, then make the first backup new primary
+			if vs.impl.drop_backup(server) {
 				changed_view = true
 			}
-			//if backup dead, clear it
+			//if a backup is dead, clear it
 			if vs.impl.server_view[server] == 0 {
 				if vs.impl.cur_view.Primary == server {
 					vs.impl.cur_view.Primary = ""
 					changed_view = true
 				}
-				if vs.impl.cur_view.Backup == server {
-					vs.impl.cur_view.Backup = ""
-					changed_view = true
-				}
 				continue
 			}
-			//if view 0, means reset, so either clear primary or backup
+			//if view 0, means reset, so clear primary too
 		}
 	}
 
 	if vs.impl.cur_view.Primary == "" {
-		for server := range vs.impl.last_ping {
+		for _, server := range vs.impl.servers() {
 			if vs.impl.tick_count-vs.impl.last_ping[server] > DeadPings {
 				continue
 			}
@@ -176,32 +292,175 @@ func (vs *ViewServer) tick_internal() {
 				continue
 			}
 			vs.impl.cur_view.Primary = server
+			vs.impl.drop_backup(server)
 			changed_view = true
 			break
 		}
 		//only update primary with valid servers
 	}
 
-	if vs.impl.cur_view.Backup == "" && vs.impl.cur_view.Primary != "" {
+	if vs.impl.cur_view.Primary == "" || (len(vs.impl.cur_view.Backups) == 0 && vs.impl.is_dead(vs.impl.cur_view.Primary)) {
+		candidate := vs.recovered_candidate()
+		if candidate != "" && candidate != vs.impl.cur_view.Primary &&
+			(vs.impl.cur_view.Primary == "" || vs.impl.lease_expired()) {
+			vs.impl.cur_view.Primary = candidate
+			vs.impl.drop_backup(candidate)
+			changed_view = true
+		}
+	}
+	//nobody initialized is left to take over, fall back to a server that recovered its state from disk
+
+	if len(vs.impl.cur_view.Backups) < vs.impl.nbackups && vs.impl.cur_view.Primary != "" {
 		primary_ack := (vs.impl.server_view[vs.impl.cur_view.Primary] == vs.impl.cur_view.Viewnum)
 		if primary_ack {
-			for server := range vs.impl.last_ping {
+			for _, server := range vs.impl.servers() {
+				if len(vs.impl.cur_view.Backups) >= vs.impl.nbackups {
+					break
+				}
 				if vs.impl.tick_count-vs.impl.last_ping[server] > DeadPings {
 					continue
 				}
-				if server == vs.impl.cur_view.Primary {
+				if server == vs.impl.cur_view.Primary || vs.impl.cur_view.IsBackup(server) {
 					continue
 				}
-				vs.impl.cur_view.Backup = server
+				vs.impl.add_backup(server)
 				changed_view = true
-				break
 			}
 		}
-		//update backup with valid servers and not currently primary
+		//fill empty backup slots with valid servers not already in the view
 	}
 
 	if changed_view {
 		vs.impl.cur_view.Viewnum++
+		vs.save()
 	}
 	//update viewnum
-}
\ No newline at end of file
+}
+
+// does args renew the primary's lease? not for a primary that just restarted
+func (impl *ViewServerImpl) grants_lease(args *PingArgs) bool {
+	return args.Viewnum != 0 && args.Me == impl.cur_view.Primary
+}
+
+// has the primary's lease run out, so that someone else may take over?
+func (impl *ViewServerImpl) lease_expired() bool {
+	return impl.tick_count-impl.lease_tick > LeaseTicks
+}
+
+func (impl *ViewServerImpl) is_dead(server string) bool {
+	last, ok := impl.last_ping[server]
+	return !ok || impl.tick_count-last > DeadPings
+}
+
+// every server that has pinged us, sorted, so the replicas of a
+// group go through them in the same order and pick the same ones
+func (impl *ViewServerImpl) servers() []string {
+	servers := make([]string, 0, len(impl.last_ping))
+	for server := range impl.last_ping {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// replace the backups of the current view, keeping Backup in step.
+// always a fresh slice: older copies of the view share the old one.
+func (impl *ViewServerImpl) set_backups(backups []string) {
+	impl.cur_view.Backups = append([]string(nil), backups...)
+	impl.cur_view.Backup = ""
+	if len(backups) > 0 {
+		impl.cur_view.Backup = backups[0]
+	}
+}
+
+func (impl *ViewServerImpl) add_backup(server string) {
+	impl.set_backups(append(append([]string(nil), impl.cur_view.Backups...), server))
+}
+
+// take server out of the backups, true if it was one
+func (impl *ViewServerImpl) drop_backup(server string) bool {
+	if !impl.cur_view.IsBackup(server) {
+		return false
+	}
+	var kept []string
+	for _, b := range impl.cur_view.Backups {
+		if b != server {
+			kept = append(kept, b)
+		}
+	}
+	impl.set_backups(kept)
+	return true
+}
+
+//
+// pick a live server whose recovered state is at least as new as
+// the last acknowledged view. anything older could be missing
+// writes that were acknowledged to clients. prefer the newest
+// state, then the old primary.
+//
+func (vs *ViewServer) recovered_candidate() string {
+	best := ""
+	for _, server := range vs.impl.servers() {
+		viewnum := vs.impl.recovered[server]
+		if viewnum == 0 || viewnum < vs.impl.acked.Viewnum || vs.impl.is_dead(server) {
+			continue
+		}
+		if best == "" || viewnum > vs.impl.recovered[best] ||
+			(viewnum == vs.impl.recovered[best] && server == vs.impl.acked.Primary) {
+			best = server
+		}
+	}
+	return best
+}
+
+//
+// pick up the state saved by an earlier run, if any. servers we
+// knew about count as having just pinged, and nobody is declared
+// dead during the grace period.
+//
+func (vs *ViewServer) restore() {
+	if vs.impl.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(vs.impl.dir, 0777); err != nil {
+		log.Fatal("view state dir: ", err)
+	}
+	st, ok, err := loadState(vs.impl.dir)
+	if err != nil {
+		log.Fatal("load view state: ", err)
+	}
+	if !ok {
+		return
+	}
+
+	vs.impl.cur_view = st.View
+	if len(st.View.Backups) == 0 && st.View.Backup != "" {
+		vs.impl.set_backups([]string{st.View.Backup})
+	}
+	//saved before views had more than one backup
+	vs.impl.acked = st.Acked
+	for server, viewnum := range st.ServerView {
+		vs.impl.server_view[server] = viewnum
+		vs.impl.last_ping[server] = 0
+	}
+	for server, viewnum := range st.Recovered {
+		vs.impl.recovered[server] = viewnum
+	}
+	vs.impl.grace = RestartGrace
+}
+
+// write the current state to disk (runs in run_channels goroutine)
+func (vs *ViewServer) save() {
+	if vs.impl.dir == "" {
+		return
+	}
+	st := savedState{
+		View:       vs.impl.cur_view,
+		ServerView: vs.impl.server_view,
+		Recovered:  vs.impl.recovered,
+		Acked:      vs.impl.acked,
+	}
+	if err := saveState(vs.impl.dir, st); err != nil {
+		log.Printf("ViewServer(%v) save state: %v\n", vs.me, err)
+	}
+}
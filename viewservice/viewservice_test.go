@@ -204,3 +204,310 @@ func Test1(t *testing.T) {
 
 	vs.Kill(vsterm)
 }
+
+func TestPersist(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("pv")
+	dir := port("pv-data")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	vsterm := make(chan interface{})
+	vs := StartServerWithOptions(vshost, Options{Dir: dir}, vsterm)
+
+	ck1 := MakeClerk(port("p1"), vshost)
+	ck2 := MakeClerk(port("p2"), vshost)
+
+	fmt.Printf("Test: Restarted viewserver keeps its view ...\n")
+
+	{
+		ck1.Ping(0)
+		time.Sleep(PingInterval)
+		ck1.Ping(1)
+		ck2.Ping(0)
+		time.Sleep(PingInterval)
+		ck1.Ping(2)
+		ck2.Ping(2)
+		check(t, ck1, ck1.me, ck2.me, 2)
+
+		vs.Kill(vsterm)
+		time.Sleep(PingInterval)
+		vsterm = make(chan interface{})
+		vs = StartServerWithOptions(vshost, Options{Dir: dir}, vsterm)
+		check(t, ck1, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Restarted viewserver waits before declaring servers dead ...\n")
+
+	{
+		// longer than DeadPings, shorter than the restart grace period
+		time.Sleep((DeadPings + 2) * PingInterval)
+		check(t, ck1, ck1.me, ck2.me, 2)
+
+		// once the grace period is over, a silent primary is replaced
+		for i := 0; i < RestartGrace+DeadPings+1; i++ {
+			ck2.Ping(2)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck2, ck2.me, "", 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestBackups(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("bv")
+	vsterm := make(chan interface{})
+	vs := StartServerWithOptions(vshost, Options{Backups: 2}, vsterm)
+
+	ck1 := MakeClerk(port("b1"), vshost)
+	ck2 := MakeClerk(port("b2"), vshost)
+	ck3 := MakeClerk(port("b3"), vshost)
+
+	fmt.Printf("Test: Views fill up to two backups ...\n")
+
+	{
+		ck1.Ping(0)
+		time.Sleep(PingInterval)
+		ck1.Ping(1)
+		ck2.Ping(0)
+		time.Sleep(PingInterval)
+		ck1.Ping(2)
+		ck3.Ping(0)
+		time.Sleep(PingInterval)
+		view, _ := ck1.Ping(3)
+		if view.Viewnum != 3 || view.Primary != ck1.me || len(view.Backups) != 2 ||
+			view.Backups[0] != ck2.me || view.Backups[1] != ck3.me || view.Backup != ck2.me {
+			t.Fatalf("wanted view 3 with backups %v, %v; got %v", ck2.me, ck3.me, view)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Backups promoted in order ...\n")
+
+	{
+		for i := 0; i < DeadPings*3; i++ {
+			v, _ := ck2.Ping(3)
+			ck3.Ping(3)
+			if v.Primary == ck2.me {
+				break
+			}
+			time.Sleep(PingInterval)
+		}
+		view, _ := ck2.Get()
+		if view.Viewnum != 4 || view.Primary != ck2.me || len(view.Backups) != 1 ||
+			view.Backup != ck3.me {
+			t.Fatalf("wanted view 4 with primary %v, backup %v; got %v", ck2.me, ck3.me, view)
+		}
+
+		// the old primary comes back and takes the empty slot
+		ck2.Ping(4)
+		ck3.Ping(4)
+		ck1.Ping(0)
+		time.Sleep(PingInterval)
+		view, _ = ck2.Ping(4)
+		if view.Viewnum != 5 || len(view.Backups) != 2 || view.Backups[1] != ck1.me {
+			t.Fatalf("wanted view 5 with %v as second backup; got %v", ck1.me, view)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestLease(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("lv")
+	vsterm := make(chan interface{})
+	vs := StartServer(vshost, vsterm)
+
+	ck1 := MakeClerk(port("l1"), vshost)
+	ck2 := MakeClerk(port("l2"), vshost)
+
+	fmt.Printf("Test: Only the primary gets a lease ...\n")
+
+	{
+		ck1.Ping(0)
+		time.Sleep(PingInterval)
+		ck1.Ping(1)
+		ck2.Ping(0)
+		time.Sleep(PingInterval)
+		view, lease, _ := ck1.PingLease(2, 0)
+		if view.Primary != ck1.me || !lease {
+			t.Fatalf("primary got no lease: %v %v", view, lease)
+		}
+		if _, lease, _ = ck2.PingLease(2, 0); lease {
+			t.Fatalf("backup got a lease")
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Backup not promoted while the lease holds ...\n")
+
+	{
+		_, _, err := ck1.PingLease(2, 0)
+		renewed := time.Now()
+		if err != nil {
+			t.Fatalf("ping failed: %v", err)
+		}
+		for i := 0; i < DeadPings*3; i++ {
+			view, _ := ck2.Ping(2)
+			if view.Primary == ck2.me {
+				if time.Since(renewed) < LeaseDuration {
+					t.Fatalf("backup promoted %v into a %v lease", time.Since(renewed), LeaseDuration)
+				}
+				break
+			}
+			time.Sleep(PingInterval)
+		}
+		check(t, ck2, ck2.me, "", 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestGroup(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	var peers []string
+	for i := 0; i < nreplicas; i++ {
+		peers = append(peers, port("g"+strconv.Itoa(i)))
+	}
+	var vsterms [nreplicas]chan interface{}
+	var vss [nreplicas]*ViewServer
+	for i := 0; i < nreplicas; i++ {
+		vsterms[i] = make(chan interface{})
+		vss[i] = StartServerWithOptions(peers[i], Options{Peers: peers}, vsterms[i])
+	}
+
+	ck1 := MakeGroupClerk(port("g-1"), peers)
+	ck2 := MakeGroupClerk(port("g-2"), peers)
+
+	fmt.Printf("Test: Replicated first primary and backup ...\n")
+
+	{
+		ck1.Ping(0)
+		time.Sleep(PingInterval)
+		check(t, ck1, ck1.me, "", 1)
+		ck1.Ping(1)
+		ck2.Ping(0)
+		time.Sleep(PingInterval)
+		check(t, ck1, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Replicated view survives a replica failure ...\n")
+
+	{
+		// replica 0 starts out as the ticker
+		vss[0].Kill(vsterms[0])
+		ck1.Ping(2)
+		ck2.Ping(2)
+		check(t, ck1, ck1.me, ck2.me, 2)
+		check(t, ck2, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Replicated backup takes over if primary fails ...\n")
+
+	{
+		// allow for another replica taking over the ticks
+		for i := 0; i < DeadPings*3; i++ {
+			ck2.Ping(2)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck2, ck2.me, "", 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Replicated viewserver waits for primary to ack view ...\n")
+
+	{
+		ck2.Ping(3)
+		ck1.Ping(0)
+		time.Sleep(PingInterval)
+		check(t, ck2, ck2.me, ck1.me, 4)
+
+		// ck2 never acks view 4, so ck1 must not be promoted
+		for i := 0; i < DeadPings*2; i++ {
+			ck1.Ping(4)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck1, ck2.me, ck1.me, 4)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	for i := 1; i < nreplicas; i++ {
+		vss[i].Kill(vsterms[i])
+	}
+}
+
+func TestGroupRestart(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	var peers []string
+	for i := 0; i < nreplicas; i++ {
+		peers = append(peers, port("r"+strconv.Itoa(i)))
+	}
+	var vsterms [nreplicas]chan interface{}
+	var vss [nreplicas]*ViewServer
+	for i := 0; i < nreplicas; i++ {
+		vsterms[i] = make(chan interface{})
+		vss[i] = StartServerWithOptions(peers[i], Options{Peers: peers}, vsterms[i])
+	}
+
+	ck1 := MakeGroupClerk(port("r-1"), peers)
+	ck2 := MakeGroupClerk(port("r-2"), peers)
+
+	ck1.Ping(0)
+	time.Sleep(PingInterval)
+	ck1.Ping(1)
+	ck2.Ping(0)
+	time.Sleep(PingInterval)
+	check(t, ck1, ck1.me, ck2.me, 2)
+
+	fmt.Printf("Test: Restarted replica catches up ...\n")
+
+	{
+		vss[0].Kill(vsterms[0])
+		// the others go on without it, and forget the log it knew
+		for i := 0; i < DeadPings*3; i++ {
+			ck1.Ping(2)
+			ck2.Ping(2)
+			time.Sleep(PingInterval)
+		}
+		vsterms[0] = make(chan interface{})
+		vss[0] = StartServerWithOptions(peers[0], Options{Peers: peers}, vsterms[0])
+
+		// only ask the restarted replica
+		ck0 := MakeGroupClerk(port("r-0"), peers[:1])
+		check(t, ck0, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Restarted replica follows the group ...\n")
+
+	{
+		ck0 := MakeGroupClerk(port("r-0"), peers[:1])
+		// ck1 stops pinging, so ck2 takes over
+		for i := 0; i < DeadPings*3; i++ {
+			ck2.Ping(2)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck0, ck2.me, "", 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nreplicas; i++ {
+		vss[i].Kill(vsterms[i])
+	}
+}